@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
@@ -9,7 +10,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/michael-robbins/go-and-chat/gochat"
-	"time"
 )
 
 func printDefaults(usageTitle string, error string) {
@@ -20,9 +20,15 @@ func printDefaults(usageTitle string, error string) {
 
 func main() {
 	connection_string := flag.String("server", "", "'hostname:port' connection string to the server")
+	codec := flag.String("codec", gochat.GOB_CODEC, "Codec the server speaks on that address ('gob' or 'json')")
 	verbose := flag.Bool("v", false, "Enables verbose logging")
 	debug := flag.Bool("debug", false, "Enables debug logging")
 	logFile := flag.String("logfile", "", "Log file location, default to StdErr")
+	useTLS := flag.Bool("tls", false, "Connect to the server using TLS")
+	caFile := flag.String("ca", "", "CA bundle to verify the server's certificate against (implies -tls)")
+	certFile := flag.String("cert", "", "Client certificate for mutual TLS (implies -tls)")
+	keyFile := flag.String("key", "", "Client certificate key for mutual TLS")
+	insecure := flag.Bool("insecure", false, "Skip verifying the server's certificate, for development only (implies -tls)")
 	flag.Parse()
 
 	usageTitle := "Usage of GoChat Client:\n"
@@ -57,11 +63,21 @@ func main() {
 	// Register all the Message struct subtypes for encoding/decoding
 	gochat.RegisterStructs()
 
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" || *insecure {
+		var err error
+		tlsConfig, err = gochat.LoadClientTLSConfig(*caFile, *certFile, *keyFile, *insecure)
+		if err != nil {
+			printDefaults(usageTitle, err.Error())
+			return
+		}
+	}
+
 	// Create the new chat client instance
 	client, _ := gochat.NewChatClient(logger)
 
 	logger.Debug("Attempting to connect to: " + *connection_string)
-	if err := client.Connect(*connection_string); err != nil {
+	if err := client.Connect(*connection_string, *codec, tlsConfig); err != nil {
 		logger.Error(err)
 		return
 	}
@@ -70,8 +86,14 @@ func main() {
 	// Spin off a thread to listen for server events
 	server_disconnect := make(chan int, 1)
 	server_messages := make(chan gochat.Message, 1)
-	auth_result := make(chan bool)
-	go client.ListenToServer(server_messages, server_disconnect, auth_result)
+	go client.ListenToServer(server_messages, server_disconnect)
+
+	// There's nothing useful left to do once the server has gone
+	go func() {
+		<-client.Disconnected()
+		fmt.Println("\nConnection lost to the server, quitting.")
+		os.Exit(1)
+	}()
 
 	// Create the channels the client will populate
 	client_messages := make(chan gochat.Message, 1)
@@ -119,30 +141,19 @@ AuthenticationLoop:
 
 			if err := client.Register(username, password); err != nil {
 				logger.Error(err)
+				fmt.Println(err)
 			}
-
-			fmt.Println("Registration request successfull, please wait for response before logging in!")
 		} else if choice == 2 {
 			// Attempt to authenticate the user
-			if err := client.Authenticate(username, password); err != nil {
+			authenticated, err := client.Authenticate(username, password)
+			if err != nil {
 				logger.Error(err)
-				return
+				fmt.Println(err)
+				continue AuthenticationLoop
 			}
 
-			timeout := make(chan bool, 1)
-			go func() {
-				time.Sleep(10 * time.Second)
-				timeout <- true
-			}()
-
-			select {
-			case result := <-auth_result:
-				if result {
-					break AuthenticationLoop
-				}
-			case <-timeout:
-				fmt.Println("Timed out waiting for authentication response!")
-				continue AuthenticationLoop
+			if authenticated {
+				break AuthenticationLoop
 			}
 		}
 	}
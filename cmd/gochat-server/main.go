@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/michael-robbins/go-and-chat/gochat"
@@ -17,10 +19,12 @@ func printDefaults(usageTitle string, error string) {
 
 func main() {
 	server := flag.String("server", "", "'hostname:port' what we will listen on")
+	codec := flag.String("codec", gochat.GOB_CODEC, "Codec spoken on the -server listener ('gob' or 'json')")
 	verbose := flag.Bool("v", false, "Enables verbose logging")
 	debug := flag.Bool("debug", false, "Enables debug logging")
 	logFile := flag.String("logfile", "", "Log file location, default to StdErr")
 	configFile := flag.String("config", "", "Configuration file")
+	admin := flag.String("admin", "", "Make this (already registered) user an administrator before starting")
 	flag.Parse()
 
 	usageTitle := "Usage of GoChat Server:\n"
@@ -72,7 +76,50 @@ func main() {
 		return
 	}
 
-	if err := chatServer.Listen(*server); err != nil {
+	// The first administrator has to come from somewhere, after that they can make more themselves
+	if *admin != "" {
+		if err := chatServer.SetAdmin(*admin, true); err != nil {
+			logger.Error(err)
+			return
+		}
+
+		logger.Warn(*admin + " is now an administrator")
+	}
+
+	// Any extra listeners from the configuration file run alongside the main one
+	for _, listener := range config.Listeners {
+		go func(listener gochat.ListenerConfig) {
+			if err := chatServer.Listen(listener.Address, listener.Codec); err != nil {
+				logger.Error(err)
+			}
+		}(listener)
+	}
+
+	if config.WebSocket.Address != "" {
+		go func() {
+			if err := chatServer.ListenWebSocket(config.WebSocket); err != nil {
+				logger.Error(err)
+			}
+		}()
+	}
+
+	// The main listener failing is as good a reason to shut down as being told to
+	listenError := make(chan error, 1)
+	go func() {
+		listenError <- chatServer.Listen(*server, *codec)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case received := <-signals:
+		logger.Warn("Received " + received.String() + ", shutting down")
+	case err := <-listenError:
+		logger.Error(err)
+	}
+
+	if err := chatServer.Shutdown(); err != nil {
 		logger.Error(err)
 	}
 }
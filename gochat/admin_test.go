@@ -0,0 +1,184 @@
+package gochat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdminCommands(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	if err := server.SetAdmin("dave", true); err == nil {
+		t.Fatal("Expected making a user that doesn't exist an administrator to fail")
+	}
+
+	if err := server.SetAdmin("alice", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody else gets to use the admin commands
+	message, _ := bob.BuildDisconnectUserMessage("carol")
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildSetAdminMessage("bob", true)
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildCreateRoomMessage("bobs", 10)
+	if _, err := bob.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{bob, carol} {
+		message, _ := client.BuildJoinRoomMessage("bobs")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Admins can manage rooms they aren't even in
+	message, _ = alice.BuildSetTopicMessage("bobs", "Under new management")
+	if _, err := alice.expect(message, SET_TOPIC); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildDisconnectUserMessage("carol")
+	if _, err := alice.expect(message, DISCONNECT_USER); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carol.waitForText("SERVER", "You have been disconnected by an administrator."); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-carol.Disconnected():
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Expected carol to be disconnected")
+	}
+
+	if err := bob.waitForMemberEvent("carol", MEMBER_OFFLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildResetPasswordMessage("bob", "hunter2")
+	if _, err := alice.expect(message, RESET_PASSWORD); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob is logged out and has to log in again with the new password
+	if err := bob.waitForText("SERVER", "Your password has been reset by an administrator."); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-bob.Disconnected():
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Expected bob to be disconnected")
+	}
+
+	other, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.authenticate("bob", "password"); err == nil {
+		t.Fatal("Expected bob's old password to stop working")
+	}
+
+	if err := other.authenticate("bob", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if other.token == bob.token {
+		t.Fatal("Expected bob to be given a new token")
+	}
+
+	message = BuildMessage(CREATE_ROOM, CreateRoomMessage{Room: "bobs2", Capacity: 10, Token: bob.token})
+	if err := other.expectError(message, AUTH_REQUIRED); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting carol takes her out of the room as well
+	message, _ = alice.BuildDeleteUserMessage("carol")
+	if _, err := alice.expect(message, DELETE_USER); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.waitForMemberEvent("carol", MEMBER_LEFT); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.authenticate("carol", "password"); err == nil {
+		t.Fatal("Expected carol to be unable to log in once deleted")
+	}
+
+	message, _ = alice.BuildDeleteUserMessage("carol")
+	if err := alice.expectError(message, USER_NOT_FOUND); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildSetAdminMessage("bob", true)
+	if _, err := alice.expect(message, SET_ADMIN); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.authenticate("bob", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !other.admin {
+		t.Fatal("Expected the TOKEN reply to say bob is now an administrator")
+	}
+
+	message, _ = alice.BuildCloseRoomMessage("bobs")
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice resetting her own password stays connected and is handed her new token
+	message, _ = alice.BuildResetPasswordMessage("alice", "hunter3")
+	reply, err := alice.expect(message, RESET_PASSWORD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := reply.Contents.(ResetPasswordMessage).Token
+	if token == "" || token == alice.token {
+		t.Fatalf("Expected alice to be sent a new token but got '%s'", token)
+	}
+
+	message, _ = alice.BuildCreateRoomMessage("alices", 10)
+	if err := alice.expectError(message, AUTH_REQUIRED); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.token = token
+
+	message, _ = alice.BuildCreateRoomMessage("alices", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,46 +2,111 @@ package gochat
 
 import (
 	"crypto/sha256"
-	"encoding/gob"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+const (
+	// How long Request waits for the server to reply before giving up
+	REPLY_TIMEOUT = time.Second * 10
+)
+
 type ChatClient struct {
-	encoder         *gob.Encoder
-	decoder         *gob.Decoder
+	connection      net.Conn
+	codec           Codec
 	logger          *log.Entry
+	features        []string
 	username        string
 	token           string
-	joinRoomResult  chan JoinRoomMessage
-	leaveRoomResult chan LeaveRoomMessage
+	admin           bool
+	pingInterval    time.Duration
+	requestLock     sync.Mutex
+	lastRequestId   int
+	pendingRequests map[int]chan Message
+	disconnected    chan bool
 }
 
 func NewChatClient(logger *log.Entry) (*ChatClient, error) {
 	return &ChatClient{logger: logger,
-		joinRoomResult:  make(chan JoinRoomMessage),
-		leaveRoomResult: make(chan LeaveRoomMessage),
+		pendingRequests: make(map[int]chan Message),
+		disconnected:    make(chan bool),
 	}, nil
 }
 
-func (client *ChatClient) Connect(connection_string string) error {
+// Connect dials the server, using TLS if tlsConfig isn't nil
+func (client *ChatClient) Connect(connection_string string, codec string, tlsConfig *tls.Config) error {
+	if !ValidCodec(codec) {
+		return errors.New("Unknown codec '" + codec + "'")
+	}
+
 	// Attempt to connect to the server returning the connection status
-	conn, err := net.Dial("tcp", connection_string)
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", connection_string, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", connection_string)
+	}
+
 	if err != nil {
 		return err
 	}
 
-	client.encoder = gob.NewEncoder(conn)
-	client.decoder = gob.NewDecoder(conn)
+	client.connection = conn
+	client.codec, _ = NewCodec(codec, conn)
+
+	if err := client.handshake(); err != nil {
+		conn.Close()
+		return err
+	}
 
 	return nil
 }
 
+func (client *ChatClient) handshake() error {
+	// Introduce ourselves, the server will refuse us if it can't speak our protocol version
+	if err := SendRemoteCommand(client.codec, BuildHelloMessage()); err != nil {
+		return err
+	}
+
+	// Don't wait forever on a server that doesn't understand the HELLO
+	client.connection.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer client.connection.SetReadDeadline(time.Time{})
+
+	message := Message{}
+	if err := client.codec.Decode(&message); err != nil {
+		return errors.New("Failed to receive the servers HELLO: " + err.Error())
+	}
+
+	hello, ok := message.Contents.(HelloMessage)
+	if message.Command != HELLO || !ok {
+		return errors.New("Server did not reply with a HELLO, it is likely running an incompatible version")
+	}
+
+	if hello.Status != SUCCESS {
+		return errors.New("Server refused our connection: " + hello.Message)
+	}
+
+	client.features = hello.Features
+	client.pingInterval = time.Duration(hello.PingInterval) * time.Second
+	client.logger.Debug(fmt.Sprintf("Negotiated protocol version %d with features %v", hello.Version, hello.Features))
+
+	return nil
+}
+
+func (client *ChatClient) HasFeature(feature string) bool {
+	return hasFeature(client.features, feature)
+}
+
 func (client *ChatClient) EventLoop(server_messages <-chan Message, client_messages <-chan Message, exit <-chan int) {
 EventLoop:
 	for {
@@ -54,7 +119,7 @@ EventLoop:
 			}
 		case message := <-client_messages:
 			// Handle the client initiated message
-			if err := SendRemoteCommand(client.encoder, message); err != nil {
+			if err := SendRemoteCommand(client.codec, message); err != nil {
 				client.logger.Error(err)
 			} else {
 				client.logger.Debug("Successfully sent " + message.Command + " message.")
@@ -68,17 +133,74 @@ EventLoop:
 	}
 }
 
+// Request sends the message with a fresh RequestId and blocks until the server replies to it
+// Anything the server sends that isn't a reply to a pending request is left for ListenToServer to pass on
+func (client *ChatClient) Request(message Message) (Message, error) {
+	replies := make(chan Message, 1)
+
+	client.requestLock.Lock()
+	client.lastRequestId++
+	message.RequestId = client.lastRequestId
+	client.pendingRequests[message.RequestId] = replies
+	client.requestLock.Unlock()
+
+	defer client.forgetRequest(message.RequestId)
+
+	if err := SendRemoteCommand(client.codec, message); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-time.After(REPLY_TIMEOUT):
+		return Message{}, errors.New("Timed out waiting for the server to reply to our " + string(message.Command) + " request")
+	}
+}
+
+func (client *ChatClient) forgetRequest(requestId int) {
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	delete(client.pendingRequests, requestId)
+}
+
+// deliverReply hands the message to whoever is waiting on its RequestId, returning false if no one is
+func (client *ChatClient) deliverReply(message Message) bool {
+	if message.RequestId == 0 {
+		return false
+	}
+
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	replies, ok := client.pendingRequests[message.RequestId]
+	if !ok {
+		return false
+	}
+
+	// The channel is buffered and only ever receives one reply, so this won't block
+	replies <- message
+	delete(client.pendingRequests, message.RequestId)
+
+	return true
+}
+
 func (client *ChatClient) Register(username string, password string) error {
 	// Hash the password
 	password_hash := sha256.Sum256([]byte(password))
 	password_hash_hex := hex.EncodeToString(password_hash[:])
 
 	client.logger.Debug("Sending registration request to the server")
-	return SendRemoteCommand(client.encoder,
-		BuildMessage(REGISTER, RegisterMessage{Username: username, PasswordHash: password_hash_hex}))
+	reply, err := client.Request(BuildMessage(REGISTER, RegisterMessage{Username: username, PasswordHash: password_hash_hex}))
+	if err != nil {
+		return err
+	}
+
+	return client.HandleServerMessage(reply)
 }
 
-func (client *ChatClient) Authenticate(username string, password string) error {
+func (client *ChatClient) Authenticate(username string, password string) (bool, error) {
 	// Save the Username
 	client.username = username
 
@@ -86,14 +208,27 @@ func (client *ChatClient) Authenticate(username string, password string) error {
 	password_hash := sha256.Sum256([]byte(password))
 	password_hash_hex := hex.EncodeToString(password_hash[:])
 
-	// Send off the authentication attempt, the response will be handled elsewhere
 	client.logger.Debug("Sending auth request to the server")
-	return SendRemoteCommand(client.encoder,
-		BuildMessage(AUTHENTICATE, AuthenticateMessage{Username: username, PasswordHash: password_hash_hex}))
+	reply, err := client.Request(BuildMessage(AUTHENTICATE, AuthenticateMessage{Username: username, PasswordHash: password_hash_hex}))
+	if err != nil {
+		return false, err
+	}
+
+	if err := client.HandleServerMessage(reply); err != nil {
+		return false, err
+	}
+
+	return client.token != "", nil
 }
 
 func (client *ChatClient) ListenToUser(message_channel chan<- Message) error {
-	client_commands := []COMMAND{LIST_ROOMS, JOIN_ROOM, CREATE_ROOM, CLOSE_ROOM}
+	client_commands := []COMMAND{LIST_ROOMS, JOIN_ROOM, CREATE_ROOM, CLOSE_ROOM, LIST_MEMBERS, SET_TOPIC, SET_DESCRIPTION, GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER,
+		SET_ACCESS, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE, EDIT_MSG, DELETE_MSG, GET_THREAD, SEND_DM, POP_DMS, LIST_DMS, UNREAD}
+
+	// Only administrators are offered the admin commands, the server wouldn't let anyone else use them anyway
+	if client.admin {
+		client_commands = append(client_commands, DISCONNECT_USER, RESET_PASSWORD, DELETE_USER, SET_ADMIN)
+	}
 
 UserMenuLoop:
 	for {
@@ -109,7 +244,9 @@ UserMenuLoop:
 
 		// Ensure that any commands that require authentication have a Token
 		switch command {
-		case LIST_ROOMS, JOIN_ROOM, CREATE_ROOM, CLOSE_ROOM:
+		case LIST_ROOMS, JOIN_ROOM, CREATE_ROOM, CLOSE_ROOM, LIST_MEMBERS, SET_TOPIC, SET_DESCRIPTION, GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER,
+			SET_ACCESS, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE, EDIT_MSG, DELETE_MSG, GET_THREAD, SEND_DM, POP_DMS, LIST_DMS, UNREAD,
+			DISCONNECT_USER, RESET_PASSWORD, DELETE_USER, SET_ADMIN:
 			if client.token == "" {
 				fmt.Println("Unable to do that, as we have not authenticated yet!")
 				continue UserMenuLoop
@@ -120,7 +257,8 @@ UserMenuLoop:
 		var roomName string
 
 		switch command {
-		case JOIN_ROOM, LEAVE_ROOM, CREATE_ROOM, CLOSE_ROOM:
+		case JOIN_ROOM, LEAVE_ROOM, CREATE_ROOM, CLOSE_ROOM, LIST_MEMBERS, SET_TOPIC, SET_DESCRIPTION, GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER,
+			SET_ACCESS, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE, EDIT_MSG, DELETE_MSG, GET_THREAD:
 			roomName = getRoomName()
 			if roomName == "" {
 				// The user has indicated to return to the main menu
@@ -140,6 +278,121 @@ UserMenuLoop:
 			}
 		}
 
+		// Populate the new topic or description if required
+		var roomSetting string
+
+		switch command {
+		case SET_TOPIC:
+			roomSetting = getUserInput("New Topic: ")
+		case SET_DESCRIPTION:
+			roomSetting = getUserInput("New Description: ")
+		}
+
+		if roomSetting == "quit" || roomSetting == "q" {
+			// The user has indicated to return to the main menu
+			continue UserMenuLoop
+		}
+
+		// Populate the member whose role is changing, or the user an admin command is about, if required
+		var memberName string
+
+		switch command {
+		case GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE:
+			memberName = getUserInput("Member: ")
+		case SEND_DM, POP_DMS, DISCONNECT_USER, RESET_PASSWORD, DELETE_USER, SET_ADMIN:
+			memberName = getUserInput("Username: ")
+		}
+
+		if memberName == "quit" || memberName == "q" {
+			// The user has indicated to return to the main menu
+			continue UserMenuLoop
+		}
+
+		switch command {
+		case GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE,
+			SEND_DM, POP_DMS, DISCONNECT_USER, RESET_PASSWORD, DELETE_USER, SET_ADMIN:
+			if memberName == "" {
+				continue UserMenuLoop
+			}
+		}
+
+		// Populate the message being edited, deleted or looked up, and its new text, if required
+		var messageId int64
+		var newText string
+
+		switch command {
+		case EDIT_MSG, DELETE_MSG, GET_THREAD:
+			messageId = getMessageId()
+			if messageId == -1 {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		if command == EDIT_MSG {
+			newText = getUserInput("New Message: ")
+			if newText == "" || newText == "quit" || newText == "q" {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		// Populate the direct message to send if required
+		var directMessage string
+
+		if command == SEND_DM {
+			directMessage = getTextMessage()
+			if directMessage == "" {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		// Populate why and for how long the member is being kicked, banned or muted if required
+		var reason string
+		var minutes int
+
+		switch command {
+		case KICK, BAN, MUTE:
+			reason = getUserInput("Reason: ")
+			if reason == "quit" || reason == "q" {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		switch command {
+		case BAN, MUTE:
+			minutes = getDuration()
+			if minutes == -1 {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		// Populate the room's access mode if required
+		var access string
+
+		switch command {
+		case SET_ACCESS:
+			access = getRoomAccess()
+			if access == "" {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
+		// Populate the new password if required
+		var password string
+
+		if command == RESET_PASSWORD || access == ACCESS_PASSWORD {
+			password = getPassword()
+			if password == "" {
+				// The user has indicated to return to the main menu
+				continue UserMenuLoop
+			}
+		}
+
 		// Generate the Message to send
 		var message Message
 		var err error
@@ -153,64 +406,175 @@ UserMenuLoop:
 			message, err = client.BuildCreateRoomMessage(roomName, roomCapacity)
 		case CLOSE_ROOM:
 			message, err = client.BuildCloseRoomMessage(roomName)
+		case LIST_MEMBERS:
+			message, err = client.BuildListMembersMessage(roomName)
+		case SET_TOPIC:
+			message, err = client.BuildSetTopicMessage(roomName, roomSetting)
+		case SET_DESCRIPTION:
+			message, err = client.BuildSetDescriptionMessage(roomName, roomSetting)
+		case GRANT_ROLE:
+			message, err = client.BuildGrantRoleMessage(roomName, memberName, ROLE_MODERATOR)
+		case REVOKE_ROLE:
+			message, err = client.BuildRevokeRoleMessage(roomName, memberName)
+		case TRANSFER_OWNER:
+			message, err = client.BuildTransferOwnerMessage(roomName, memberName)
+		case SET_ACCESS:
+			message, err = client.BuildSetAccessMessage(roomName, access, password)
+		case INVITE:
+			message, err = client.BuildInviteMessage(roomName, memberName)
+		case UNINVITE:
+			message, err = client.BuildUninviteMessage(roomName, memberName)
+		case KICK:
+			message, err = client.BuildKickMessage(roomName, memberName, reason)
+		case BAN:
+			message, err = client.BuildBanMessage(roomName, memberName, reason, time.Duration(minutes)*time.Minute)
+		case UNBAN:
+			message, err = client.BuildUnbanMessage(roomName, memberName)
+		case MUTE:
+			message, err = client.BuildMuteMessage(roomName, memberName, reason, time.Duration(minutes)*time.Minute)
+		case UNMUTE:
+			message, err = client.BuildUnmuteMessage(roomName, memberName)
+		case EDIT_MSG:
+			message, err = client.BuildEditMessageMessage(roomName, messageId, newText)
+		case DELETE_MSG:
+			message, err = client.BuildDeleteMessageMessage(roomName, messageId)
+		case GET_THREAD:
+			message, err = client.BuildGetThreadMessage(roomName, messageId)
+		case SEND_DM:
+			message, err = client.BuildSendDirectMessage(directMessage, memberName)
+		case POP_DMS:
+			message, err = client.BuildPopulateDirectMessages(memberName, time.Time{})
+		case LIST_DMS:
+			message, err = client.BuildListDirectMessagesMessage()
+		case UNREAD:
+			message, err = client.BuildUnreadMessage()
+		case DISCONNECT_USER:
+			message, err = client.BuildDisconnectUserMessage(memberName)
+		case RESET_PASSWORD:
+			message, err = client.BuildResetPasswordMessage(memberName, password)
+		case DELETE_USER:
+			message, err = client.BuildDeleteUserMessage(memberName)
+		case SET_ADMIN:
+			message, err = client.BuildSetAdminMessage(memberName, getYesOrNo("Make "+memberName+" an administrator? (y/n): "))
 		}
 
-		// Send the Message into the queue or print out the error and continue the main loop
 		if err != nil {
 			fmt.Println(err)
-		} else {
+			continue UserMenuLoop
+		}
+
+		// Send the Message into the queue and continue the main loop
+		if command != JOIN_ROOM {
 			message_channel <- message
+			continue UserMenuLoop
 		}
 
-		// The user now thinks they're in a room, so we enter 'room' mode and poll them for messages to send
-		if command == JOIN_ROOM {
-			// Wait until we get a response that the join room succeeded
-			joinMsg := <-client.joinRoomResult
+		// Wait until we get a response that the join room succeeded
+		reply, err := client.Request(message)
+		if err != nil {
+			fmt.Println(err)
+			continue UserMenuLoop
+		}
 
-			if joinMsg.Status != SUCCESS {
-				textMsg := joinMsg.Message
-				textMsg.Username = "SERVER"
-				textMsg.Room = joinMsg.Room
+		// Password protected rooms need asking again with the password
+		var roomPassword string
 
-				client.DisplayTextMessage(textMsg)
-				continue
+		if errorMsg, ok := reply.Contents.(ErrorMessage); ok && errorMsg.Code == WRONG_PASSWORD {
+			client.HandleServerMessage(reply)
+
+			roomPassword = getUserInput("Room Password: ")
+			if roomPassword == "" || roomPassword == "quit" || roomPassword == "q" {
+				continue UserMenuLoop
 			}
 
-			// Send a 'populate' message requesting backfill of messages for this room
-			backfill_message, err := client.BuildPopulateMessage(roomName, time.Now().Add(-time.Hour*48))
-			message_channel <- backfill_message
+			message, _ = client.BuildJoinProtectedRoomMessage(roomName, roomPassword, false)
+			reply, err = client.Request(message)
+			if err != nil {
+				fmt.Println(err)
+				continue UserMenuLoop
+			}
+		}
 
-			// Keep looping asking for messages to send until they quit
-			for {
-				textMessage := getTextMessage()
+		// Offer to queue for a full room, the server will tell us when we've been let in
+		if errorMsg, ok := reply.Contents.(ErrorMessage); ok && errorMsg.Code == ROOM_FULL {
+			client.HandleServerMessage(reply)
 
-				if textMessage == "" {
-					// ServerUser has indicated to leave the room
-					message, err = client.BuildLeaveRoomMessage(roomName)
-					if err != nil {
-						fmt.Println(err)
-					} else {
-						// Send the leave room request
-						message_channel <- message
-					}
+			if !getYesOrNo("Wait for a space in " + roomName + "? (y/n): ") {
+				continue UserMenuLoop
+			}
 
-					// Wait for the response, but just ignore it and bail anyway
-					<-client.leaveRoomResult
+			message, _ = client.BuildJoinProtectedRoomMessage(roomName, roomPassword, true)
+			reply, err = client.Request(message)
+			if err != nil {
+				fmt.Println(err)
+				continue UserMenuLoop
+			}
+		}
 
-					break
-				}
+		// Anything other than a JOIN_ROOM reply (Eg. a RECV_MSG from the server) means we didn't join
+		joinMsg, ok := reply.Contents.(JoinRoomMessage)
+		if !ok {
+			client.HandleServerMessage(reply)
+			continue UserMenuLoop
+		}
+
+		if joinMsg.Status != SUCCESS {
+			textMsg := joinMsg.Message
+			textMsg.Username = "SERVER"
+			textMsg.Room = joinMsg.Room
 
+			client.DisplayTextMessage(textMsg)
+			continue
+		}
+
+		// The user is now in the room, so we enter 'room' mode and poll them for messages to send
+		// Send a 'populate' message requesting backfill of messages for this room
+		// We pick up from the last message we read here, or the last 48 hours if we've never read any
+		backfill_message, err := client.BuildPopulateSinceLastReadMessage(roomName, time.Now().Add(-time.Hour*48))
+		message_channel <- backfill_message
+
+		fmt.Println("Type '/reply <id> <message>' to reply to a message or '/thread <id>' to see its thread.")
+
+		// Keep looping asking for messages to send until they quit
+		for {
+			textMessage := getTextMessage()
+
+			if textMessage == "" {
 				// ServerUser has indicated to leave the room
-				message, err = client.BuildSendMessageMessage(textMessage, roomName)
+				message, err = client.BuildLeaveRoomMessage(roomName)
 				if err != nil {
 					fmt.Println(err)
-					break
-				} else {
-					message_channel <- message
+				} else if _, err := client.Request(message); err != nil {
+					// Whatever the response is we bail out of the room anyway
+					client.logger.Error(err)
 				}
 
-				// Continue the loop asking for another text message to send
+				break
 			}
+
+			roomCommand, messageId, text, err := parseRoomInput(textMessage)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			switch roomCommand {
+			case ROOM_INPUT_REPLY:
+				message, err = client.BuildReplyMessage(text, roomName, messageId)
+			case ROOM_INPUT_THREAD:
+				message, err = client.BuildGetThreadMessage(roomName, messageId)
+			default:
+				message, err = client.BuildSendMessageMessage(text, roomName)
+			}
+
+			if err != nil {
+				fmt.Println(err)
+				break
+			} else {
+				message_channel <- message
+			}
+
+			// Continue the loop asking for another text message to send
 		}
 	}
 }
@@ -224,12 +588,30 @@ func (client *ChatClient) BuildListRoomsMessage() (Message, error) {
 }
 
 func (client *ChatClient) BuildJoinRoomMessage(room string) (Message, error) {
+	return client.BuildJoinProtectedRoomMessage(room, "", false)
+}
+
+// BuildWaitlistRoomMessage joins the room, or joins its waitlist if it's full
+func (client *ChatClient) BuildWaitlistRoomMessage(room string) (Message, error) {
+	return client.BuildJoinProtectedRoomMessage(room, "", true)
+}
+
+// BuildJoinProtectedRoomMessage joins a room that needs a password, an empty password is left out altogether
+func (client *ChatClient) BuildJoinProtectedRoomMessage(room string, password string, waitlist bool) (Message, error) {
+	var password_hash_hex string
+
+	if password != "" {
+		password_hash := sha256.Sum256([]byte(password))
+		password_hash_hex = hex.EncodeToString(password_hash[:])
+	}
+
 	return BuildMessage(JOIN_ROOM,
 		JoinRoomMessage{
-			Username:    client.username,
-			Room:        room,
-			IsSuperUser: false,
-			Token:       client.token,
+			Username:     client.username,
+			Room:         room,
+			Token:        client.token,
+			Waitlist:     waitlist,
+			PasswordHash: password_hash_hex,
 		}), nil
 }
 
@@ -247,14 +629,76 @@ func (client *ChatClient) BuildLeaveRoomMessage(room string) (Message, error) {
 }
 
 func (client *ChatClient) BuildCreateRoomMessage(room string, capacity int) (Message, error) {
+	return client.BuildCreateRoomWithAccessMessage(room, capacity, ACCESS_PUBLIC, "")
+}
+
+// BuildCreateRoomWithAccessMessage creates a room with one of the ACCESS_* modes, password is only used by ACCESS_PASSWORD
+func (client *ChatClient) BuildCreateRoomWithAccessMessage(room string, capacity int, access string, password string) (Message, error) {
 	if client.token == "" {
 		return Message{}, errors.New("Unable to create a Room as we have not authenticated yet!")
 	}
 
+	var password_hash_hex string
+
+	if access == ACCESS_PASSWORD && password != "" {
+		password_hash := sha256.Sum256([]byte(password))
+		password_hash_hex = hex.EncodeToString(password_hash[:])
+	}
+
 	return BuildMessage(CREATE_ROOM,
 		CreateRoomMessage{
+			Room:         room,
+			Capacity:     capacity,
+			Access:       access,
+			PasswordHash: password_hash_hex,
+			Token:        client.token,
+		}), nil
+}
+
+// BuildSetAccessMessage changes who can see and join the room, password is only used by ACCESS_PASSWORD
+func (client *ChatClient) BuildSetAccessMessage(room string, access string, password string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to change a Room's access as we have not authenticated yet!")
+	}
+
+	var password_hash_hex string
+
+	if access == ACCESS_PASSWORD && password != "" {
+		password_hash := sha256.Sum256([]byte(password))
+		password_hash_hex = hex.EncodeToString(password_hash[:])
+	}
+
+	return BuildMessage(SET_ACCESS,
+		SetAccessMessage{
+			Room:         room,
+			Access:       access,
+			PasswordHash: password_hash_hex,
+			Token:        client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildInviteMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to invite a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(INVITE,
+		InviteMessage{
 			Room:     room,
-			Capacity: capacity,
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildUninviteMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to uninvite a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(UNINVITE,
+		UninviteMessage{
+			Room:     room,
+			Username: username,
 			Token:    client.token,
 		}), nil
 }
@@ -271,7 +715,216 @@ func (client *ChatClient) BuildCloseRoomMessage(room string) (Message, error) {
 		}), nil
 }
 
+func (client *ChatClient) BuildListMembersMessage(room string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to list a Room's members as we have not authenticated yet!")
+	}
+
+	return BuildMessage(LIST_MEMBERS,
+		ListMembersMessage{
+			Room:  room,
+			Token: client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildSetTopicMessage(room string, topic string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to set a Room's topic as we have not authenticated yet!")
+	}
+
+	return BuildMessage(SET_TOPIC,
+		SetTopicMessage{
+			Room:  room,
+			Topic: topic,
+			Token: client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildSetDescriptionMessage(room string, description string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to set a Room's description as we have not authenticated yet!")
+	}
+
+	return BuildMessage(SET_DESCRIPTION,
+		SetDescriptionMessage{
+			Room:        room,
+			Description: description,
+			Token:       client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildGrantRoleMessage(room string, username string, role string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to grant a role as we have not authenticated yet!")
+	}
+
+	return BuildMessage(GRANT_ROLE,
+		GrantRoleMessage{
+			Room:     room,
+			Username: username,
+			Role:     role,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildRevokeRoleMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to revoke a role as we have not authenticated yet!")
+	}
+
+	return BuildMessage(REVOKE_ROLE,
+		RevokeRoleMessage{
+			Room:     room,
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildTransferOwnerMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to transfer a Room as we have not authenticated yet!")
+	}
+
+	return BuildMessage(TRANSFER_OWNER,
+		TransferOwnerMessage{
+			Room:     room,
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildKickMessage(room string, username string, reason string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to kick a member as we have not authenticated yet!")
+	}
+
+	return BuildMessage(KICK,
+		KickMessage{
+			Room:     room,
+			Username: username,
+			Reason:   reason,
+			Token:    client.token,
+		}), nil
+}
+
+// BuildBanMessage bans the user from the room for the duration, a duration of 0 bans them permanently
+func (client *ChatClient) BuildBanMessage(room string, username string, reason string, duration time.Duration) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to ban a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(BAN,
+		BanMessage{
+			Room:     room,
+			Username: username,
+			Reason:   reason,
+			Duration: int(duration / time.Second),
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildUnbanMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to unban a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(UNBAN,
+		UnbanMessage{
+			Room:     room,
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+// BuildMuteMessage mutes the user in the room for the duration, a duration of 0 mutes them permanently
+func (client *ChatClient) BuildMuteMessage(room string, username string, reason string, duration time.Duration) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to mute a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(MUTE,
+		MuteMessage{
+			Room:     room,
+			Username: username,
+			Reason:   reason,
+			Duration: int(duration / time.Second),
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildUnmuteMessage(room string, username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to unmute a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(UNMUTE,
+		UnmuteMessage{
+			Room:     room,
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildDisconnectUserMessage(username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to disconnect a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(DISCONNECT_USER,
+		DisconnectUserMessage{
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildResetPasswordMessage(username string, password string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to reset a password as we have not authenticated yet!")
+	}
+
+	// Hash the password, the server only ever sees the hash
+	password_hash := sha256.Sum256([]byte(password))
+	password_hash_hex := hex.EncodeToString(password_hash[:])
+
+	return BuildMessage(RESET_PASSWORD,
+		ResetPasswordMessage{
+			Username:     username,
+			PasswordHash: password_hash_hex,
+			Token:        client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildDeleteUserMessage(username string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to delete a user as we have not authenticated yet!")
+	}
+
+	return BuildMessage(DELETE_USER,
+		DeleteUserMessage{
+			Username: username,
+			Token:    client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildSetAdminMessage(username string, admin bool) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to change an administrator as we have not authenticated yet!")
+	}
+
+	return BuildMessage(SET_ADMIN,
+		SetAdminMessage{
+			Username: username,
+			Admin:    admin,
+			Token:    client.token,
+		}), nil
+}
+
 func (client *ChatClient) BuildSendMessageMessage(content string, room string) (Message, error) {
+	return client.BuildReplyMessage(content, room, 0)
+}
+
+// BuildReplyMessage sends a message replying to the room message with the ID replyTo, 0 sends an ordinary message
+func (client *ChatClient) BuildReplyMessage(content string, room string, replyTo int64) (Message, error) {
 	if client.token == "" {
 		return Message{}, errors.New("Unable to send Message as we have not authenticated yet!")
 	}
@@ -279,7 +932,44 @@ func (client *ChatClient) BuildSendMessageMessage(content string, room string) (
 	return BuildMessage(SEND_MSG,
 		SendTextMessage{
 			Token:   client.token,
-			Message: TextMessage{Username: client.username, Text: content, Room: room},
+			Message: TextMessage{Username: client.username, Text: content, Room: room, ReplyTo: replyTo},
+		}), nil
+}
+
+func (client *ChatClient) BuildGetThreadMessage(room string, id int64) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to fetch a thread as we have not authenticated yet!")
+	}
+
+	return BuildMessage(GET_THREAD,
+		GetThreadMessage{
+			Room:  room,
+			Id:    id,
+			Token: client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildEditMessageMessage(room string, id int64, content string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to edit a Message as we have not authenticated yet!")
+	}
+
+	return BuildMessage(EDIT_MSG,
+		EditTextMessage{
+			Token:   client.token,
+			Message: TextMessage{Id: id, Room: room, Text: content},
+		}), nil
+}
+
+func (client *ChatClient) BuildDeleteMessageMessage(room string, id int64) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to delete a Message as we have not authenticated yet!")
+	}
+
+	return BuildMessage(DELETE_MSG,
+		DeleteTextMessage{
+			Token:   client.token,
+			Message: TextMessage{Id: id, Room: room},
 		}), nil
 }
 
@@ -296,7 +986,69 @@ func (client *ChatClient) BuildPopulateMessage(roomName string, timeSince time.T
 		}), nil
 }
 
-func (client *ChatClient) ListenToServer(notify chan<- Message, exit <-chan int, auth chan<- bool) error {
+// BuildPopulateSinceLastReadMessage asks for the room's messages we haven't read yet, falling back to timeSince if we've never read any
+func (client *ChatClient) BuildPopulateSinceLastReadMessage(roomName string, timeSince time.Time) (Message, error) {
+	message, err := client.BuildPopulateMessage(roomName, timeSince)
+	if err != nil {
+		return message, err
+	}
+
+	contents := message.Contents.(PopulateMessages)
+	contents.SinceLastRead = true
+	message.Contents = contents
+
+	return message, nil
+}
+
+func (client *ChatClient) BuildUnreadMessage() (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to check for unread messages as we have not authenticated yet!")
+	}
+
+	return BuildMessage(UNREAD, UnreadMessage{Token: client.token}), nil
+}
+
+func (client *ChatClient) BuildSendDirectMessage(content string, recipient string) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to send a direct message as we have not authenticated yet!")
+	}
+
+	return BuildMessage(SEND_DM,
+		SendDirectMessage{
+			Recipient: recipient,
+			Message:   TextMessage{Username: client.username, Text: content},
+			Token:     client.token,
+		}), nil
+}
+
+// BuildPopulateDirectMessages asks for the conversation with the user, the zero time fetches it from the start
+func (client *ChatClient) BuildPopulateDirectMessages(username string, timeSince time.Time) (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to fetch direct messages as we have not authenticated yet!")
+	}
+
+	var since int
+	if !timeSince.IsZero() {
+		since = int(timeSince.Unix())
+	}
+
+	return BuildMessage(POP_DMS,
+		PopulateDirectMessages{
+			Username:  username,
+			TimeSince: since,
+			Token:     client.token,
+		}), nil
+}
+
+func (client *ChatClient) BuildListDirectMessagesMessage() (Message, error) {
+	if client.token == "" {
+		return Message{}, errors.New("Unable to list direct messages as we have not authenticated yet!")
+	}
+
+	return BuildMessage(LIST_DMS, ListDirectMessagesMessage{Token: client.token}), nil
+}
+
+func (client *ChatClient) ListenToServer(notify chan<- Message, exit <-chan int) error {
 	var empty_message Message
 
 ListenLoop:
@@ -309,22 +1061,41 @@ ListenLoop:
 			fmt.Print("")
 		}
 
+		// If the server PINGs us, we expect to hear from it at least that often
+		if client.HasFeature(FEATURE_HEARTBEAT) && client.pingInterval > 0 {
+			client.connection.SetReadDeadline(time.Now().Add(client.pingInterval * 3))
+		}
+
 		message := Message{}
-		client.decoder.Decode(&message)
+		if err := client.codec.Decode(&message); err != nil {
+			// Whether it timed out, closed the connection or sent garbage, we can't carry on talking to the server
+			client.logger.Error(err)
+			close(client.disconnected)
+			return err
+		}
 
 		if message == empty_message {
-			// If we did not decode anything just sleep for a second and try again
-			time.Sleep(time.Second * 1)
 			continue ListenLoop
 		}
 
-		if message.Command == TOKEN {
-			tokenMsg := message.Contents.(TokenMessage)
-			if tokenMsg.Token != "" {
-				auth <- true
-			} else {
-				auth <- false
+		// Answer heartbeats straight away so the server knows we're still here
+		if message.Command == PING {
+			if err := SendRemoteCommand(client.codec, BuildMessage(PONG, message.Contents)); err != nil {
+				client.logger.Error(err)
 			}
+
+			continue ListenLoop
+		}
+
+		// The connection is about to drop, so show the notice now rather than waiting on the EventLoop
+		if message.Command == SERVER_SHUTDOWN {
+			client.HandleServerMessage(message)
+			continue ListenLoop
+		}
+
+		// Replies to requests go straight to whoever sent the request
+		if client.deliverReply(message) {
+			continue ListenLoop
 		}
 
 		notify <- message
@@ -333,6 +1104,11 @@ ListenLoop:
 	return nil
 }
 
+// Disconnected is closed once ListenToServer loses the connection to the server
+func (client *ChatClient) Disconnected() <-chan bool {
+	return client.disconnected
+}
+
 func (client *ChatClient) HandleServerMessage(message Message) error {
 	// Interpret Message
 	switch message.Command {
@@ -341,7 +1117,16 @@ func (client *ChatClient) HandleServerMessage(message Message) error {
 
 		if contents.Token != "" {
 			client.token = contents.Token
+			client.admin = contents.Admin
 			fmt.Println(contents.Message)
+
+			if contents.Admin {
+				fmt.Println("You are an administrator.")
+			}
+
+			if len(contents.Rooms) > 0 {
+				fmt.Println("You are still a member of: " + strings.Join(contents.Rooms, ", ") + " (join them again to catch up)")
+			}
 		} else {
 			fmt.Println(contents.Message)
 		}
@@ -352,15 +1137,118 @@ func (client *ChatClient) HandleServerMessage(message Message) error {
 	case LIST_ROOMS:
 		contents := message.Contents.(ListRoomsMessage)
 		client.DisplayRoomListingMessage(contents)
+	case LIST_MEMBERS:
+		contents := message.Contents.(ListMembersMessage)
+		client.DisplayMemberListingMessage(contents)
+	case MEMBER_EVENT:
+		contents := message.Contents.(MemberEventMessage)
+		client.DisplayMemberEventMessage(contents)
+	case SET_TOPIC:
+		contents := message.Contents.(SetTopicMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Topic set to: " + contents.Topic})
+	case SET_DESCRIPTION:
+		contents := message.Contents.(SetDescriptionMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Description set to: " + contents.Description})
+	case GRANT_ROLE:
+		contents := message.Contents.(GrantRoleMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: contents.Username + " is now a " + contents.Role})
+	case REVOKE_ROLE:
+		contents := message.Contents.(RevokeRoleMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: contents.Username + " is now a " + ROLE_MEMBER})
+	case TRANSFER_OWNER:
+		contents := message.Contents.(TransferOwnerMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: contents.Username + " now owns " + contents.Room})
+	case SET_ACCESS:
+		contents := message.Contents.(SetAccessMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Access set to: " + contents.Access})
+	case INVITE:
+		contents := message.Contents.(InviteMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Invited " + contents.Username})
+	case UNINVITE:
+		contents := message.Contents.(UninviteMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Took back the invite for " + contents.Username})
+	case KICK:
+		contents := message.Contents.(KickMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Kicked " + contents.Username})
+	case BAN:
+		contents := message.Contents.(BanMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Banned " + contents.Username + describeExpiry(contents.Expires)})
+	case UNBAN:
+		contents := message.Contents.(UnbanMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Unbanned " + contents.Username})
+	case MUTE:
+		contents := message.Contents.(MuteMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Muted " + contents.Username + describeExpiry(contents.Expires)})
+	case UNMUTE:
+		contents := message.Contents.(UnmuteMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "Unmuted " + contents.Username})
+	case DISCONNECT_USER:
+		contents := message.Contents.(DisconnectUserMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: "SERVER", Text: "Disconnected " + contents.Username})
+	case RESET_PASSWORD:
+		contents := message.Contents.(ResetPasswordMessage)
+
+		// We reset our own password, carry on with the new token
+		if contents.Token != "" {
+			client.token = contents.Token
+		}
+
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: "SERVER", Text: "Reset the password of " + contents.Username})
+	case DELETE_USER:
+		contents := message.Contents.(DeleteUserMessage)
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: "SERVER", Text: "Deleted " + contents.Username})
+	case SET_ADMIN:
+		contents := message.Contents.(SetAdminMessage)
+		text := contents.Username + " is no longer an administrator"
+		if contents.Admin {
+			text = contents.Username + " is now an administrator"
+		}
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: "SERVER", Text: text})
 	case POP_MSGS:
 		contents := message.Contents.(PopulateMessages)
 		client.DisplayPopulateMessages(contents)
 	case JOIN_ROOM:
 		contents := message.Contents.(JoinRoomMessage)
-		client.joinRoomResult <- contents
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: contents.Message.Text})
+	case RECV_DM:
+		contents := message.Contents.(RecvDirectMessage)
+		client.DisplayDirectMessage(contents.Recipient, contents.Message)
+	case POP_DMS:
+		contents := message.Contents.(PopulateDirectMessages)
+		client.DisplayPopulateDirectMessages(contents)
+	case LIST_DMS:
+		contents := message.Contents.(ListDirectMessagesMessage)
+		client.DisplayConversationListingMessage(contents)
+	case UNREAD:
+		contents := message.Contents.(UnreadMessage)
+		client.DisplayUnreadMessage(contents)
+	case GET_THREAD:
+		contents := message.Contents.(GetThreadMessage)
+		client.DisplayThreadMessage(contents)
+	case EDIT_MSG:
+		contents := message.Contents.(EditTextMessage)
+		if contents.Status == SUCCESS {
+			client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Message.Room, Text: fmt.Sprintf("Edited #%d", contents.Message.Id)})
+		} else {
+			client.DisplayTextMessage(contents.Message)
+		}
+	case DELETE_MSG:
+		contents := message.Contents.(DeleteTextMessage)
+		if contents.Status == SUCCESS {
+			client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Message.Room, Text: fmt.Sprintf("Deleted #%d", contents.Message.Id)})
+		} else {
+			client.DisplayTextMessage(contents.Message)
+		}
+	case ERROR:
+		contents := message.Contents.(ErrorMessage)
+		client.DisplayErrorMessage(contents)
+	case SERVER_SHUTDOWN:
+		contents := message.Contents.(ServerShutdownMessage)
+		client.DisplayShutdownMessage(contents)
 	case LEAVE_ROOM:
+		// The server has removed us from a room (Eg. it was closed)
 		contents := message.Contents.(LeaveRoomMessage)
-		client.leaveRoomResult <- contents
+		client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: contents.Room, Text: "You are no longer in this room."})
 	default:
 		// Unknown Message command
 		return errors.New("Unable to determine incoming Message type from server.")
@@ -369,15 +1257,185 @@ func (client *ChatClient) HandleServerMessage(message Message) error {
 	return nil
 }
 
+// describeExpiry says how long a ban or mute lasts, the zero time means forever
+func describeExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return " permanently"
+	}
+
+	return " until " + expires.Format(time.RFC822)
+}
+
+// DisplayTextMessage shows a room message with its ID (so it can be edited or deleted), marking it if it has been edited or deleted
 func (client *ChatClient) DisplayTextMessage(message TextMessage) {
-	fmt.Println("["+message.Room+"] "+message.Username+":", message.Text)
+	prefix := "[" + message.Room + "] "
+	if message.Id != 0 {
+		prefix += fmt.Sprintf("#%d ", message.Id)
+	}
+
+	username := message.Username
+	if message.ReplyTo != 0 {
+		username += fmt.Sprintf(" (reply to #%d)", message.ReplyTo)
+	}
+
+	text := message.Text
+	if message.Deleted {
+		text = "(deleted)"
+	} else if message.Edited {
+		text += " (edited)"
+	}
+
+	fmt.Println(prefix+username+":", text)
+}
+
+// DisplayThreadMessage shows a thread with the replies indented under the messages they reply to
+func (client *ChatClient) DisplayThreadMessage(message GetThreadMessage) {
+	fmt.Printf("Thread for #%d in %s:\n", message.Id, message.Room)
+
+	depths := make(map[int64]int)
+	for _, textMessage := range message.Messages {
+		depth := 0
+		if parent, ok := depths[textMessage.ReplyTo]; ok && textMessage.ReplyTo != 0 {
+			depth = parent + 1
+		}
+		depths[textMessage.Id] = depth
+
+		fmt.Print(strings.Repeat("    ", depth))
+		client.DisplayTextMessage(textMessage)
+	}
+}
+
+// DisplayDirectMessage shows who a direct message was from, or who it went to if we sent it
+func (client *ChatClient) DisplayDirectMessage(recipient string, message TextMessage) {
+	if message.Username == client.username {
+		fmt.Println("[DM to "+recipient+"] "+message.Username+":", message.Text)
+	} else {
+		fmt.Println("[DM] "+message.Username+":", message.Text)
+	}
+}
+
+func (client *ChatClient) DisplayPopulateDirectMessages(message PopulateDirectMessages) {
+	if len(message.Messages) == 0 {
+		fmt.Println("No direct messages with " + message.Username + ".")
+		return
+	}
+
+	for _, textMessage := range message.Messages {
+		recipient := message.Username
+		if textMessage.Username == message.Username {
+			recipient = client.username
+		}
+
+		client.DisplayDirectMessage(recipient, textMessage)
+	}
+}
+
+func (client *ChatClient) DisplayConversationListingMessage(message ListDirectMessagesMessage) {
+	if len(message.Conversations) == 0 {
+		fmt.Println("You have no direct messages!")
+		return
+	}
+
+	fmt.Println("Direct Messages:")
+	for _, conversation := range message.Conversations {
+		fmt.Printf("* %s (%d messages, last at %s)\n", conversation.Username, conversation.Messages, conversation.LastMessageAt.Format(time.RFC822))
+	}
+}
+
+func (client *ChatClient) DisplayUnreadMessage(message UnreadMessage) {
+	if len(message.Rooms) == 0 {
+		fmt.Println("You aren't in any rooms!")
+		return
+	}
+
+	fmt.Println("Unread Messages:")
+	for _, count := range message.Rooms {
+		fmt.Printf("* %s (%d unread)\n", count.Room, count.Unread)
+	}
+}
+
+func (client *ChatClient) DisplayErrorMessage(message ErrorMessage) {
+	fmt.Println("[ERROR] " + string(message.Command) + " failed (" + string(message.Code) + "): " + message.Message)
+}
+
+func (client *ChatClient) DisplayShutdownMessage(message ServerShutdownMessage) {
+	fmt.Println("\n[SERVER] " + message.Message)
+	if message.ReconnectHint != "" {
+		fmt.Println("[SERVER] Reconnect hint: " + message.ReconnectHint)
+	}
 }
 
 func (client *ChatClient) DisplayRoomListingMessage(message ListRoomsMessage) {
+	if len(message.RoomInfos) == 0 {
+		fmt.Println("There are no rooms!")
+		return
+	}
+
 	fmt.Println("Room Listing:")
-	for _, room := range message.Rooms {
-		fmt.Println("* " + room)
+	for _, room := range message.RoomInfos {
+		occupancy := fmt.Sprintf("%d members, %d online", room.Members, room.Online)
+		if room.Capacity > 0 {
+			occupancy = fmt.Sprintf("%d/%d members, %d online", room.Members, room.Capacity, room.Online)
+		}
+
+		if room.Access != "" && room.Access != ACCESS_PUBLIC {
+			occupancy += ", " + room.Access
+		}
+
+		fmt.Println("* " + room.Name + " (" + occupancy + ")")
+
+		if room.Topic != "" {
+			fmt.Println("    Topic: " + room.Topic)
+		}
+
+		if room.Description != "" {
+			fmt.Println("    " + room.Description)
+		}
+
+		if room.Owner != "" {
+			fmt.Println("    Created by " + room.Owner + " on " + room.CreatedAt.Format(time.RFC822))
+		}
+	}
+}
+
+func (client *ChatClient) DisplayMemberListingMessage(message ListMembersMessage) {
+	fmt.Println("Members of " + message.Room + ":")
+	for _, member := range message.Members {
+		presence := "offline"
+		if member.Online {
+			presence = "online"
+		}
+
+		fmt.Println("* " + member.Username + " (" + member.Role + ", " + presence + ", joined " + member.JoinedAt.Format(time.RFC822) + ")")
+	}
+}
+
+func (client *ChatClient) DisplayMemberEventMessage(message MemberEventMessage) {
+	var text string
+
+	switch message.Event {
+	case MEMBER_JOINED:
+		text = message.Member.Username + " has joined!"
+	case MEMBER_LEFT:
+		text = message.Member.Username + " has left!"
+	case MEMBER_ONLINE:
+		text = message.Member.Username + " is online."
+	case MEMBER_OFFLINE:
+		text = message.Member.Username + " has gone offline."
+	case MEMBER_ROLE:
+		switch message.Member.Role {
+		case ROLE_OWNER:
+			text = message.Member.Username + " is now the owner."
+		case ROLE_MODERATOR:
+			text = message.Member.Username + " is now a moderator."
+		default:
+			text = message.Member.Username + " is no longer a moderator."
+		}
+	default:
+		text = message.Member.Username + " " + message.Event
 	}
+
+	client.DisplayTextMessage(TextMessage{Username: "SERVER", Room: message.Room, Text: text})
 }
 
 func (client *ChatClient) DisplayPopulateMessages(message PopulateMessages) {
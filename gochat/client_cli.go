@@ -2,9 +2,11 @@ package gochat
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func getUserInput(message string) string {
@@ -68,6 +70,26 @@ func getRoomName() string {
 	return roomName
 }
 
+// getPassword asks for a new password twice, returning "" if the user gives up
+func getPassword() string {
+	for {
+		password := getUserInput("New Password: ")
+		if password == "quit" || password == "q" {
+			return ""
+		}
+
+		if password == "" {
+			continue
+		}
+
+		if getUserInput("New Password (again): ") == password {
+			return password
+		}
+
+		fmt.Println("Passwords do not match!")
+	}
+}
+
 func getRoomCapacity() int {
 	roomCapacity := -1
 
@@ -96,6 +118,109 @@ func getRoomCapacity() int {
 	return roomCapacity
 }
 
+// getRoomAccess asks for one of the ACCESS_* modes, returning "" if the user gives up
+func getRoomAccess() string {
+	for {
+		access := getUserInput("Access (" + strings.Join([]string{ACCESS_PUBLIC, ACCESS_UNLISTED, ACCESS_PASSWORD, ACCESS_INVITE}, ", ") + "): ")
+
+		switch access {
+		case "quit", "q":
+			return ""
+		case ACCESS_PUBLIC, ACCESS_UNLISTED, ACCESS_PASSWORD, ACCESS_INVITE:
+			return access
+		}
+
+		fmt.Println("Invalid choice.")
+	}
+}
+
+// getDuration asks how many minutes a ban or mute should last, 0 is forever and -1 means the user gave up
+func getDuration() int {
+	for {
+		text := getUserInput("Minutes (0 for permanent): ")
+		if text == "quit" || text == "q" {
+			return -1
+		}
+
+		minutes, err := strconv.Atoi(text)
+		if err != nil || minutes < 0 {
+			fmt.Println("Invalid choice (only numbers >=0 please).")
+			continue
+		}
+
+		return minutes
+	}
+}
+
+// getMessageId asks for the ID of a room message (shown as #ID next to it), returning -1 if the user gives up
+func getMessageId() int64 {
+	for {
+		text := strings.TrimPrefix(getUserInput("Message ID: "), "#")
+		if text == "quit" || text == "q" {
+			return -1
+		}
+
+		id, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || id < 1 {
+			fmt.Println("Invalid choice (only numbers >0 please).")
+			continue
+		}
+
+		return id
+	}
+}
+
+const (
+	ROOM_INPUT_REPLY  = "/reply"
+	ROOM_INPUT_THREAD = "/thread"
+)
+
+// parseRoomInput picks out '/reply <id> <message>' and '/thread <id>' from what's typed in a room
+// Anything else (including unknown /commands) is returned untouched as a message to send
+func parseRoomInput(text string) (string, int64, string, error) {
+	fields := strings.SplitN(text, " ", 3)
+
+	switch fields[0] {
+	case ROOM_INPUT_REPLY:
+		if len(fields) < 3 || strings.TrimSpace(fields[2]) == "" {
+			return "", 0, "", errors.New("Usage: /reply <id> <message>")
+		}
+	case ROOM_INPUT_THREAD:
+		if len(fields) < 2 {
+			return "", 0, "", errors.New("Usage: /thread <id>")
+		}
+	default:
+		return "", 0, text, nil
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(fields[1], "#"), 10, 64)
+	if err != nil || id < 1 {
+		return "", 0, "", errors.New("Invalid message ID '" + fields[1] + "' (only numbers >0 please).")
+	}
+
+	var message string
+	if len(fields) == 3 {
+		message = fields[2]
+	}
+
+	return fields[0], id, message, nil
+}
+
+func getYesOrNo(message string) bool {
+	for {
+		text := getUserInput(message)
+
+		switch text {
+		case "y", "yes":
+			return true
+		case "n", "no", "quit", "q":
+			return false
+		}
+
+		fmt.Println("Invalid choice (only 'y' or 'n' please).")
+	}
+}
+
 func getTextMessage() string {
 	var textMessage string
 
@@ -0,0 +1,34 @@
+package gochat
+
+import "testing"
+
+func TestParseRoomInput(t *testing.T) {
+	for _, test := range []struct {
+		input   string
+		command string
+		id      int64
+		text    string
+		invalid bool
+	}{
+		{input: "hello there", text: "hello there"},
+		{input: "/shrug", text: "/shrug"},
+		{input: "/reply 12 sounds good", command: ROOM_INPUT_REPLY, id: 12, text: "sounds good"},
+		{input: "/reply #12 sounds good", command: ROOM_INPUT_REPLY, id: 12, text: "sounds good"},
+		{input: "/thread 7", command: ROOM_INPUT_THREAD, id: 7},
+		{input: "/reply 12", invalid: true},
+		{input: "/reply twelve sounds good", invalid: true},
+		{input: "/thread", invalid: true},
+	} {
+		command, id, text, err := parseRoomInput(test.input)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Expected '%s' to be rejected", test.input)
+			}
+			continue
+		}
+
+		if err != nil || command != test.command || id != test.id || text != test.text {
+			t.Errorf("Expected '%s' to give (%q, %d, %q) but got (%q, %d, %q, %v)", test.input, test.command, test.id, test.text, command, id, text, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package gochat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+const (
+	GOB_CODEC  = "gob"
+	JSON_CODEC = "json"
+
+	// The longest line the JSON codec will read, so a peer can't have us buffer without end
+	MAX_JSON_LINE = 1024 * 1024
+)
+
+var ErrJSONLineTooLong = errors.New("JSON message is longer than the maximum allowed")
+
+type Encoder interface {
+	Encode(message Message) error
+}
+
+type Decoder interface {
+	Decode(message *Message) error
+}
+
+// A Codec reads and writes Message envelopes on a single connection
+// Encode is safe to call from multiple goroutines, Decode is expected to only be called by the connection's reader
+type Codec interface {
+	Encoder
+	Decoder
+}
+
+func NewCodec(name string, connection io.ReadWriter) (Codec, error) {
+	switch name {
+	case GOB_CODEC, "":
+		return NewGobCodec(connection), nil
+	case JSON_CODEC:
+		return NewJSONCodec(connection), nil
+	}
+
+	return nil, errors.New("Unknown codec '" + name + "' (valid codecs are: " + GOB_CODEC + ", " + JSON_CODEC + ")")
+}
+
+func ValidCodec(name string) bool {
+	switch name {
+	case GOB_CODEC, JSON_CODEC, "":
+		return true
+	}
+
+	return false
+}
+
+type GobCodec struct {
+	lock    sync.Mutex
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func NewGobCodec(connection io.ReadWriter) *GobCodec {
+	return &GobCodec{encoder: gob.NewEncoder(connection), decoder: gob.NewDecoder(connection)}
+}
+
+func (codec *GobCodec) Encode(message Message) error {
+	codec.lock.Lock()
+	defer codec.lock.Unlock()
+
+	return codec.encoder.Encode(message)
+}
+
+func (codec *GobCodec) Decode(message *Message) error {
+	return codec.decoder.Decode(message)
+}
+
+// JSONCodec speaks newline delimited JSON, one Message envelope per line
+// Eg. {"Command":"Join Room","Contents":{"Username":"bob","Room":"lobby","Token":"..."}}
+type JSONCodec struct {
+	lock   sync.Mutex
+	writer io.Writer
+	reader *bufio.Reader
+}
+
+func NewJSONCodec(connection io.ReadWriter) *JSONCodec {
+	return &JSONCodec{writer: connection, reader: bufio.NewReader(connection)}
+}
+
+func (codec *JSONCodec) Encode(message Message) error {
+	line, err := encodeJSONMessage(message)
+	if err != nil {
+		return err
+	}
+
+	codec.lock.Lock()
+	defer codec.lock.Unlock()
+
+	_, err = codec.writer.Write(line)
+	return err
+}
+
+func (codec *JSONCodec) Decode(message *Message) error {
+	for {
+		line, err := codec.readLine()
+		if err == ErrJSONLineTooLong {
+			return err
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return err
+			}
+
+			// Skip blank lines, they're handy when typing commands by hand
+			continue
+		}
+
+		return decodeJSONMessage(line, message)
+	}
+}
+
+// readLine reads up to and including the next newline, giving up once the line is longer than MAX_JSON_LINE
+func (codec *JSONCodec) readLine() ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, err := codec.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > MAX_JSON_LINE {
+			return nil, ErrJSONLineTooLong
+		}
+
+		line = append(line, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// encodeJSONMessage returns the message as a single line of JSON (including the trailing newline)
+func encodeJSONMessage(message Message) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(message); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeJSONMessage(data []byte, message *Message) error {
+	var envelope struct {
+		Command   COMMAND
+		RequestId int
+		Contents  json.RawMessage
+	}
+
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	message.Command = envelope.Command
+	message.RequestId = envelope.RequestId
+	message.Contents = nil
+
+	// JSON doesn't carry Go types, so the Command tells us what the Contents should decode into
+	contentsType, ok := COMMAND_CONTENTS[envelope.Command]
+	if !ok {
+		// Leave the Contents empty and let the handler decide what to do with an unknown command
+		return nil
+	}
+
+	contents := reflect.New(reflect.TypeOf(contentsType))
+	if len(envelope.Contents) > 0 {
+		if err := json.Unmarshal(envelope.Contents, contents.Interface()); err != nil {
+			return errors.New("Unable to decode the contents of a '" + string(envelope.Command) + "' message: " + err.Error())
+		}
+	}
+
+	message.Contents = contents.Elem().Interface()
+	return nil
+}
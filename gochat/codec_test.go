@@ -0,0 +1,94 @@
+package gochat
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillSample sets every field of the value to something other than its zero value, so nothing can go missing unnoticed
+func fillSample(t *testing.T, value reflect.Value, seed int) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(fmt.Sprintf("%s %d", value.Type().Name(), seed))
+	case reflect.Int, reflect.Int64:
+		value.SetInt(int64(seed))
+	case reflect.Bool:
+		value.SetBool(true)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(value.Type(), 2, 2)
+		for i := 0; i < slice.Len(); i++ {
+			fillSample(t, slice.Index(i), seed*10+i)
+		}
+		value.Set(slice)
+	case reflect.Struct:
+		if value.Type() == reflect.TypeOf(time.Time{}) {
+			value.Set(reflect.ValueOf(time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC).Add(time.Duration(seed) * time.Minute)))
+			return
+		}
+
+		for i := 0; i < value.NumField(); i++ {
+			fillSample(t, value.Field(i), seed+i+1)
+		}
+	default:
+		t.Fatalf("No sample for a %s in a %s", value.Kind(), value.Type())
+	}
+}
+
+func TestCodecsRoundTripEveryCommand(t *testing.T) {
+	RegisterStructs()
+
+	codecs := []struct {
+		name string
+		new  func(buffer *bytes.Buffer) Codec
+	}{
+		{GOB_CODEC, func(buffer *bytes.Buffer) Codec { return NewGobCodec(buffer) }},
+		{JSON_CODEC, func(buffer *bytes.Buffer) Codec { return NewJSONCodec(buffer) }},
+	}
+
+	for _, codec := range codecs {
+		for command, contentsType := range COMMAND_CONTENTS {
+			t.Run(codec.name+"/"+string(command), func(t *testing.T) {
+				contents := reflect.New(reflect.TypeOf(contentsType)).Elem()
+				fillSample(t, contents, 1)
+
+				message := Message{Command: command, RequestId: 42, Contents: contents.Interface()}
+
+				var buffer bytes.Buffer
+				wire := codec.new(&buffer)
+
+				if err := wire.Encode(message); err != nil {
+					t.Fatal(err)
+				}
+
+				decoded := Message{}
+				if err := wire.Decode(&decoded); err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(decoded, message) {
+					t.Fatalf("Expected %+v but got back %+v", message, decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestJSONCodecRefusesOversizedLines(t *testing.T) {
+	// No newline in sight, the codec must give up rather than keep reading
+	buffer := bytes.NewBufferString(strings.Repeat("a", MAX_JSON_LINE+1))
+
+	if err := NewJSONCodec(buffer).Decode(&Message{}); err != ErrJSONLineTooLong {
+		t.Fatalf("Expected %v but got %v", ErrJSONLineTooLong, err)
+	}
+
+	// Just under the limit is still read, and then rejected as the JSON it isn't
+	buffer = bytes.NewBufferString(strings.Repeat("a", MAX_JSON_LINE-1) + "\n")
+
+	if err := NewJSONCodec(buffer).Decode(&Message{}); err == nil || err == ErrJSONLineTooLong {
+		t.Fatalf("Expected a line under the limit to be read and fail to decode but got %v", err)
+	}
+}
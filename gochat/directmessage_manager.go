@@ -0,0 +1,231 @@
+package gochat
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	CREATE_DIRECT_MESSAGE_SQL    = "INSERT INTO direct_messages (sender_id, recipient_id, message, epoch_timestamp, delivered) VALUES (?, ?, ?, ?, ?)"
+	MARK_DIRECT_MESSAGE_SQL      = "UPDATE direct_messages SET delivered=? WHERE id=?"
+	MARK_DIRECT_MESSAGES_SQL     = "UPDATE direct_messages SET delivered=? WHERE recipient_id=? AND delivered=? AND id<=?"
+	GET_UNDELIVERED_MESSAGES_SQL = `
+	SELECT
+		d.id AS id,
+		s.username AS sender,
+		r.username AS recipient,
+		d.message AS message,
+		d.epoch_timestamp AS epoch_timestamp
+	FROM
+		direct_messages AS d
+	JOIN
+		users AS s ON (d.sender_id = s.id)
+	JOIN
+		users AS r ON (d.recipient_id = r.id)
+	WHERE
+		d.recipient_id=?
+		AND d.delivered=?
+	ORDER BY
+		d.id
+	`
+	GET_DIRECT_MESSAGES_SQL = `
+	SELECT
+		s.username AS sender,
+		r.username AS recipient,
+		d.message AS message,
+		d.epoch_timestamp AS epoch_timestamp
+	FROM
+		direct_messages AS d
+	JOIN
+		users AS s ON (d.sender_id = s.id)
+	JOIN
+		users AS r ON (d.recipient_id = r.id)
+	WHERE
+		((d.sender_id=? AND d.recipient_id=?) OR (d.sender_id=? AND d.recipient_id=?))
+		AND d.epoch_timestamp>=?
+	ORDER BY
+		d.id
+	LIMIT ?
+	`
+	GET_DIRECT_CONVERSATIONS_SQL = `
+	SELECT
+		u.username AS username,
+		COUNT(*) AS messages,
+		MAX(d.epoch_timestamp) AS last_message
+	FROM
+		direct_messages AS d
+	JOIN
+		users AS u ON (u.id = CASE WHEN d.sender_id=? THEN d.recipient_id ELSE d.sender_id END)
+	WHERE
+		d.sender_id=?
+		OR d.recipient_id=?
+	GROUP BY
+		u.username
+	ORDER BY
+		last_message DESC
+	`
+	DIRECT_MESSAGE_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS direct_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender_id INTEGER,
+		recipient_id INTEGER,
+		message TEXT,
+		epoch_timestamp INT,
+		delivered BOOLEAN
+	)`
+)
+
+type DirectMessage struct {
+	Id        int64  `db:"id"`
+	Sender    string `db:"sender"`
+	Recipient string `db:"recipient"`
+	Message   string `db:"message"`
+	Timestamp int64  `db:"epoch_timestamp"`
+}
+
+func (message DirectMessage) TextMessage() TextMessage {
+	return TextMessage{Username: message.Sender, Text: message.Message, Time: time.Unix(message.Timestamp, 0)}
+}
+
+type directConversation struct {
+	Username    string `db:"username"`
+	Messages    int    `db:"messages"`
+	LastMessage int64  `db:"last_message"`
+}
+
+// DirectMessageManager stores messages sent between two users, holding on to them until the recipient is online
+// Messages are stored as undelivered and only marked delivered once one of the recipient's sessions has taken them,
+// the lock stops a recipient coming online at the same time being sent one twice
+type DirectMessageManager struct {
+	storageManager *StorageManager
+	logger         *log.Entry
+	lock           sync.Mutex
+}
+
+func NewDirectMessageManager(storageManager *StorageManager, logger *log.Entry) (*DirectMessageManager, error) {
+	// Create the direct_messages table if it doesn't already exist
+	_, err := storageManager.db.Exec(DIRECT_MESSAGE_SCHEMA)
+	if err != nil {
+		logger.Error(err)
+		return &DirectMessageManager{}, errors.New("Failed to generate the direct message schema.")
+	}
+
+	manager := DirectMessageManager{
+		storageManager: storageManager,
+		logger:         logger,
+	}
+
+	return &manager, nil
+}
+
+// PersistDirectMessage stores the message and tries to deliver it, it's only marked delivered if deliver returns true
+// Otherwise it's kept back for TakeUndelivered once the recipient connects
+func (manager *DirectMessageManager) PersistDirectMessage(sender *ServerUser, recipient *ServerUser, message string, sent time.Time, deliver func() bool) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	sql := manager.storageManager.db.Rebind(CREATE_DIRECT_MESSAGE_SQL)
+	result, err := manager.storageManager.db.Exec(sql, sender.User.Id, recipient.User.Id, message, sent.Unix(), false)
+	if err := manager.storageManager.ExecOneRow(result, err); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run CREATE_DIRECT_MESSAGE_SQL")
+	}
+
+	if !deliver() {
+		return nil
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to get the ID of the new direct message")
+	}
+
+	sql = manager.storageManager.db.Rebind(MARK_DIRECT_MESSAGE_SQL)
+	if err := manager.storageManager.ExecOneRow(manager.storageManager.db.Exec(sql, true, id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run MARK_DIRECT_MESSAGE_SQL")
+	}
+
+	return nil
+}
+
+// TakeUndelivered hands deliver the messages sent to the user while they were offline, oldest first
+// Those it takes are marked as delivered, from the first one it doesn't take onwards they're kept for next time
+func (manager *DirectMessageManager) TakeUndelivered(recipient *ServerUser, deliver func(DirectMessage) bool) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	var messages []DirectMessage
+
+	sql := manager.storageManager.db.Rebind(GET_UNDELIVERED_MESSAGES_SQL)
+	if err := manager.storageManager.db.Select(&messages, sql, recipient.User.Id, false); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run GET_UNDELIVERED_MESSAGES_SQL")
+	}
+
+	var lastId int64
+	for _, message := range messages {
+		if !deliver(message) {
+			break
+		}
+
+		lastId = message.Id
+	}
+
+	if lastId == 0 {
+		return nil
+	}
+
+	sql = manager.storageManager.db.Rebind(MARK_DIRECT_MESSAGES_SQL)
+	if _, err := manager.storageManager.db.Exec(sql, true, recipient.User.Id, false, lastId); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run MARK_DIRECT_MESSAGES_SQL")
+	}
+
+	return nil
+}
+
+// GetDirectMessagesSince returns the messages the two users have sent each other, oldest first
+func (manager *DirectMessageManager) GetDirectMessagesSince(user *ServerUser, other *ServerUser, timeSince time.Time, limit int) ([]TextMessage, error) {
+	var rows []DirectMessage
+
+	sql := manager.storageManager.db.Rebind(GET_DIRECT_MESSAGES_SQL)
+	err := manager.storageManager.db.Select(&rows, sql, user.User.Id, other.User.Id, other.User.Id, user.User.Id, timeSince.Unix(), limit)
+	if err != nil {
+		manager.logger.Error(err)
+		return nil, errors.New("Failed to run GET_DIRECT_MESSAGES_SQL")
+	}
+
+	messages := []TextMessage{}
+	for _, row := range rows {
+		messages = append(messages, row.TextMessage())
+	}
+
+	return messages, nil
+}
+
+// GetConversations lists everyone the user has swapped direct messages with, most recently active first
+func (manager *DirectMessageManager) GetConversations(user *ServerUser) ([]DirectConversation, error) {
+	var rows []directConversation
+
+	sql := manager.storageManager.db.Rebind(GET_DIRECT_CONVERSATIONS_SQL)
+	if err := manager.storageManager.db.Select(&rows, sql, user.User.Id, user.User.Id, user.User.Id); err != nil {
+		manager.logger.Error(err)
+		return nil, errors.New("Failed to run GET_DIRECT_CONVERSATIONS_SQL")
+	}
+
+	conversations := []DirectConversation{}
+	for _, row := range rows {
+		conversations = append(conversations, DirectConversation{
+			Username:      row.Username,
+			Messages:      row.Messages,
+			LastMessageAt: time.Unix(row.LastMessage, 0),
+		})
+	}
+
+	return conversations, nil
+}
@@ -0,0 +1,219 @@
+package gochat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForDirectMessage waits for a RECV_DM from username with the given text
+func (client *testClient) waitForDirectMessage(username string, text string) error {
+	message, err := client.waitForCommand(RECV_DM)
+	if err != nil {
+		return err
+	}
+
+	contents := message.Contents.(RecvDirectMessage)
+	if contents.Message.Username != username || contents.Message.Text != text {
+		return fmt.Errorf("Expected '%s' from %s but got '%s' from %s", text, username, contents.Message.Text, contents.Message.Username)
+	}
+
+	return nil
+}
+
+func TestDirectMessages(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		clients[username] = client
+	}
+
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	for _, username := range []string{"alice", "bob"} {
+		if err := clients[username].login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Carol registers but stays offline for now
+	password_hash := sha256.Sum256([]byte("password"))
+	if _, err := carol.expect(BuildMessage(REGISTER, RegisterMessage{Username: "carol", PasswordHash: hex.EncodeToString(password_hash[:])}), RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildSendDirectMessage("hi bob", "bob")
+	if err := SendRemoteCommand(alice.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.waitForDirectMessage("alice", "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender gets a copy for their other sessions
+	if err := alice.waitForDirectMessage("alice", "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildSendDirectMessage("hi carol", "carol")
+	if err := SendRemoteCommand(alice.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.waitForDirectMessage("alice", "hi carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildSendDirectMessage("hello?", "nobody")
+	if err := alice.expectError(message, USER_NOT_FOUND); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildSendDirectMessage("hello me", "alice")
+	if err := alice.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol is handed what she missed when she logs in, and only the once
+	if err := carol.authenticate("carol", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carol.waitForDirectMessage("alice", "hi carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Her other client predates direct messages
+	other, err := connectTestClientWithHello(address, HelloMessage{Version: PROTOCOL_VERSION, Features: featuresWithout(FEATURE_DIRECT)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.authenticate("carol", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildSendDirectMessage("hi alice", "alice")
+	if err := SendRemoteCommand(carol.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.waitForText("carol", "hi alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildListDirectMessagesMessage()
+	reply, err := alice.expect(message, LIST_DMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversations := reply.Contents.(ListDirectMessagesMessage).Conversations
+	if len(conversations) != 2 {
+		t.Fatalf("Expected alice to have 2 conversations but got %v", conversations)
+	}
+
+	for _, conversation := range conversations {
+		expected := map[string]int{"bob": 1, "carol": 2}[conversation.Username]
+		if conversation.Messages != expected {
+			t.Fatalf("Expected %d messages with %s but got %d", expected, conversation.Username, conversation.Messages)
+		}
+	}
+
+	message, _ = carol.BuildPopulateDirectMessages("alice", time.Time{})
+	reply, err = carol.expect(message, POP_DMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := reply.Contents.(PopulateDirectMessages).Messages
+	if len(history) != 2 || history[0].Text != "hi carol" || history[1].Text != "hi alice" {
+		t.Fatalf("Expected carol's history with alice to be both messages in order but got %v", history)
+	}
+
+	// Bob only ever sees his own conversations
+	message, _ = bob.BuildListDirectMessagesMessage()
+	reply, err = bob.expect(message, LIST_DMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conversations := reply.Contents.(ListDirectMessagesMessage).Conversations; len(conversations) != 1 || conversations[0].Username != "alice" {
+		t.Fatalf("Expected bob to only have a conversation with alice but got %v", conversations)
+	}
+}
+
+func TestDirectMessagesStayUndeliveredUntilTaken(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	for _, username := range []string{"alice", "bob"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		client.Close()
+	}
+
+	alice, _ := server.userManager.GetUser("alice")
+	bob, _ := server.userManager.GetUser("bob")
+
+	// A push that no session took leaves the message waiting
+	for _, text := range []string{"one", "two", "three"} {
+		if err := server.directMessageManager.PersistDirectMessage(alice, bob, text, time.Now(), func() bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := server.directMessageManager.PersistDirectMessage(alice, bob, "delivered", time.Now(), func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping part of the way through keeps the rest for next time
+	var taken []string
+	err := server.directMessageManager.TakeUndelivered(bob, func(message DirectMessage) bool {
+		if message.Message == "three" {
+			return false
+		}
+
+		taken = append(taken, message.Message)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(taken) != "[one two]" {
+		t.Fatalf("Expected bob to be handed the first two messages but got %v", taken)
+	}
+
+	taken = nil
+	err = server.directMessageManager.TakeUndelivered(bob, func(message DirectMessage) bool {
+		taken = append(taken, message.Message)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(taken) != "[three]" {
+		t.Fatalf("Expected only the message bob didn't take to be left but got %v", taken)
+	}
+}
@@ -2,35 +2,167 @@ package gochat
 
 import (
 	"encoding/gob"
+	"fmt"
 	"time"
 )
 
+const (
+	// PROTOCOL_VERSION is the version of the wire protocol this build speaks
+	// MIN_PROTOCOL_VERSION is the oldest version we are still able to talk to
+	// Version 2 added RoomInfo records to LIST_ROOMS, version 1 clients are still only sent the names
+	PROTOCOL_VERSION     = 2
+	MIN_PROTOCOL_VERSION = 1
+
+	// How long either side waits for the other to complete the HELLO exchange
+	HANDSHAKE_TIMEOUT = time.Second * 10
+
+	// How often the server PINGs clients unless configured otherwise
+	DEFAULT_PING_INTERVAL = time.Second * 30
+
+	// How long the server spends winding down unless configured otherwise
+	DEFAULT_SHUTDOWN_TIMEOUT = time.Second * 10
+)
+
+const (
+	FEATURE_REQUEST_IDS = "request-ids"
+	FEATURE_ERRORS      = "errors"
+	FEATURE_HEARTBEAT   = "heartbeat"
+	FEATURE_SHUTDOWN    = "shutdown-notice"
+	FEATURE_PRESENCE    = "presence"
+	FEATURE_EDITS       = "edits"
+	FEATURE_DIRECT      = "direct-messages"
+)
+
+// SUPPORTED_FEATURES is advertised during the HELLO exchange, peers only use features both sides list
+var SUPPORTED_FEATURES = []string{FEATURE_REQUEST_IDS, FEATURE_ERRORS, FEATURE_HEARTBEAT, FEATURE_SHUTDOWN, FEATURE_PRESENCE, FEATURE_EDITS, FEATURE_DIRECT}
+
 type COMMAND string
 
 const (
-	REGISTER     = COMMAND("Register")
-	AUTHENTICATE = COMMAND("Authenticate")
-	TOKEN        = COMMAND("Token")
-	LIST_ROOMS   = COMMAND("List Rooms")
-	JOIN_ROOM    = COMMAND("Join Room")
-	LEAVE_ROOM   = COMMAND("Leave Room")
-	CREATE_ROOM  = COMMAND("Create Room")
-	CLOSE_ROOM   = COMMAND("Close Room")
-	SEND_MSG     = COMMAND("Send Message")
-	RECV_MSG     = COMMAND("Receive Message")
-	POP_MSGS     = COMMAND("Populate Messages")
+	HELLO           = COMMAND("Hello")
+	REGISTER        = COMMAND("Register")
+	AUTHENTICATE    = COMMAND("Authenticate")
+	TOKEN           = COMMAND("Token")
+	LIST_ROOMS      = COMMAND("List Rooms")
+	JOIN_ROOM       = COMMAND("Join Room")
+	LEAVE_ROOM      = COMMAND("Leave Room")
+	CREATE_ROOM     = COMMAND("Create Room")
+	CLOSE_ROOM      = COMMAND("Close Room")
+	SEND_MSG        = COMMAND("Send Message")
+	RECV_MSG        = COMMAND("Receive Message")
+	POP_MSGS        = COMMAND("Populate Messages")
+	ERROR           = COMMAND("Error")
+	PING            = COMMAND("Ping")
+	PONG            = COMMAND("Pong")
+	SERVER_SHUTDOWN = COMMAND("Server Shutdown")
+	LIST_MEMBERS    = COMMAND("List Members")
+	MEMBER_EVENT    = COMMAND("Member Event")
+	SET_TOPIC       = COMMAND("Set Topic")
+	SET_DESCRIPTION = COMMAND("Set Description")
+	GRANT_ROLE      = COMMAND("Grant Role")
+	REVOKE_ROLE     = COMMAND("Revoke Role")
+	TRANSFER_OWNER  = COMMAND("Transfer Ownership")
+	DISCONNECT_USER = COMMAND("Disconnect User")
+	RESET_PASSWORD  = COMMAND("Reset Password")
+	DELETE_USER     = COMMAND("Delete User")
+	SET_ADMIN       = COMMAND("Set Admin")
+	KICK            = COMMAND("Kick")
+	BAN             = COMMAND("Ban")
+	UNBAN           = COMMAND("Unban")
+	MUTE            = COMMAND("Mute")
+	UNMUTE          = COMMAND("Unmute")
+	SET_ACCESS      = COMMAND("Set Access")
+	INVITE          = COMMAND("Invite")
+	UNINVITE        = COMMAND("Uninvite")
+	SEND_DM         = COMMAND("Send Direct Message")
+	RECV_DM         = COMMAND("Receive Direct Message")
+	POP_DMS         = COMMAND("Populate Direct Messages")
+	LIST_DMS        = COMMAND("List Direct Messages")
+	UNREAD          = COMMAND("Unread")
+	EDIT_MSG        = COMMAND("Edit Message")
+	DELETE_MSG      = COMMAND("Delete Message")
+	GET_THREAD      = COMMAND("Get Thread")
 )
 
 type STATUS string
 
 const (
-	SUCCESS = STATUS("Request was successfull")
-	FAILURE = STATUS("Request failed")
+	SUCCESS    = STATUS("Request was successfull")
+	FAILURE    = STATUS("Request failed")
+	WAITLISTED = STATUS("Waiting for a space")
 )
 
+type ERROR_CODE string
+
+const (
+	AUTH_REQUIRED       = ERROR_CODE("auth_required")
+	TOKEN_EXPIRED       = ERROR_CODE("token_expired")
+	INVALID_CREDENTIALS = ERROR_CODE("invalid_credentials")
+	USERNAME_TAKEN      = ERROR_CODE("username_taken")
+	USER_NOT_FOUND      = ERROR_CODE("user_not_found")
+	ROOM_NOT_FOUND      = ERROR_CODE("room_not_found")
+	ROOM_CLOSED         = ERROR_CODE("room_closed")
+	ROOM_EXISTS         = ERROR_CODE("room_exists")
+	ROOM_FULL           = ERROR_CODE("room_full")
+	NOT_IN_ROOM         = ERROR_CODE("not_in_room")
+	PERMISSION_DENIED   = ERROR_CODE("permission_denied")
+	BANNED              = ERROR_CODE("banned")
+	MUTED               = ERROR_CODE("muted")
+	WRONG_PASSWORD      = ERROR_CODE("wrong_password")
+	NOT_INVITED         = ERROR_CODE("not_invited")
+	MESSAGE_NOT_FOUND   = ERROR_CODE("message_not_found")
+	BAD_REQUEST         = ERROR_CODE("bad_request")
+	UNKNOWN_COMMAND     = ERROR_CODE("unknown_command")
+	INTERNAL_ERROR      = ERROR_CODE("internal_error")
+)
+
+// ChatError is an error that knows which ERROR_CODE it should be reported to the client as
+type ChatError struct {
+	Code    ERROR_CODE
+	Message string
+}
+
+func (err *ChatError) Error() string {
+	return err.Message
+}
+
+func NewChatError(code ERROR_CODE, message string) error {
+	return &ChatError{Code: code, Message: message}
+}
+
+// RequestId is chosen by the client, the server copies it into its reply so the client can match them up
+// Messages the server pushes on its own (Eg. room broadcasts) have a RequestId of 0
 type Message struct {
-	Command  COMMAND
-	Contents interface{}
+	Command   COMMAND
+	RequestId int
+	Contents  interface{}
+}
+
+// PingInterval is only set by the server, it's how many seconds apart its PINGs will be
+type HelloMessage struct {
+	Version      int
+	Features     []string
+	PingInterval int
+	Status       STATUS
+	Message      string
+}
+
+// PingMessage is sent back untouched in the PONG
+type PingMessage struct {
+	Time time.Time
+}
+
+// ErrorMessage is the reply to any request that failed, Command is the command of the failed request
+type ErrorMessage struct {
+	Code    ERROR_CODE
+	Message string
+	Command COMMAND
+}
+
+// ServerShutdownMessage is pushed to every client just before the server disconnects them
+type ServerShutdownMessage struct {
+	Message       string
+	ReconnectHint string
 }
 
 type RegisterMessage struct {
@@ -43,17 +175,27 @@ type AuthenticateMessage struct {
 	PasswordHash string
 }
 
+// Rooms lists the rooms the user is still a member of from earlier sessions
 type TokenMessage struct {
 	Username string
 	Token    string
 	Message  string
+	Rooms    []string
+	Admin    bool
 }
 
+// TextMessage is a message sent to a room (or directly to a user), Id is given out by the server for room messages
+// Edited and Deleted mark messages that have been changed since they were sent, a deleted message has no Text
+// ReplyTo is the Id of the room message this one is replying to, 0 if it isn't a reply
 type TextMessage struct {
+	Id       int64
 	Username string
 	Room     string
 	Text     string
 	Time     time.Time
+	Edited   bool
+	Deleted  bool
+	ReplyTo  int64
 }
 
 type SendTextMessage struct {
@@ -65,25 +207,90 @@ type RecvTextMessage struct {
 	Message TextMessage
 }
 
+// EditTextMessage replaces the Text of the room message with the given Id, only its author or a moderator can edit it
+// Everyone in the room is sent the edited message under the same command, the reply to the editor has a Status
+type EditTextMessage struct {
+	Token   string
+	Message TextMessage
+	Status  STATUS
+}
+
+// DeleteTextMessage removes the room message with the given Id, with the same rules as EditTextMessage
+type DeleteTextMessage struct {
+	Token   string
+	Message TextMessage
+	Status  STATUS
+}
+
+// PopulateMessages fetches the room's history, marking what's returned as read
+// SinceLastRead starts from the last message the user read instead of TimeSince, if they've read any
 type PopulateMessages struct {
-	Room      string
-	Messages  []TextMessage
-	TimeSince int
-	Limit     int
-	Token     string
+	Room          string
+	Messages      []TextMessage
+	TimeSince     int
+	SinceLastRead bool
+	Limit         int
+	Token         string
+}
+
+// GetThreadMessage fetches the thread the message with the given Id belongs to, from its first message on
+type GetThreadMessage struct {
+	Room     string
+	Id       int64
+	Messages []TextMessage
+	Token    string
+}
+
+type UnreadCount struct {
+	Room   string
+	Unread int
+}
+
+// UnreadMessage returns how many messages are waiting to be read in each of the user's rooms
+type UnreadMessage struct {
+	Rooms []UnreadCount
+	Token string
 }
 
+// Public rooms are listed and open to everyone, unlisted rooms are open to anyone who knows their name
+// Password rooms are listed but need their password to join, invite rooms are only seen and joined by those invited
+const (
+	ACCESS_PUBLIC   = "public"
+	ACCESS_UNLISTED = "unlisted"
+	ACCESS_PASSWORD = "password"
+	ACCESS_INVITE   = "invite"
+)
+
+// RoomInfo describes a room, Members is everyone in it and Online how many of them are connected
+type RoomInfo struct {
+	Name        string
+	Topic       string
+	Description string
+	Owner       string
+	CreatedAt   time.Time
+	Capacity    int
+	Access      string
+	Members     int
+	Online      int
+}
+
+// Rooms is the names, as version 1 sent them, RoomInfos is only sent to version 2 clients
 type ListRoomsMessage struct {
-	Rooms []string
+	Rooms     []string
+	RoomInfos []RoomInfo
 }
 
+// Setting Waitlist asks to wait for a space if the room is full, rather than be turned away
+// The server pushes a JOIN_ROOM with a SUCCESS Status once the user has been let in
+// PasswordHash is only needed for ACCESS_PASSWORD rooms, it's hashed the same way as for AUTHENTICATE
 type JoinRoomMessage struct {
-	Username    string
-	Room        string
-	IsSuperUser bool
-	Token       string
-	Status      STATUS
-	Message     TextMessage
+	Username     string
+	Room         string
+	Token        string
+	Waitlist     bool
+	PasswordHash string
+	Status       STATUS
+	Message      TextMessage
 }
 
 type LeaveRoomMessage struct {
@@ -94,10 +301,37 @@ type LeaveRoomMessage struct {
 	Message  TextMessage
 }
 
+// Access defaults to ACCESS_PUBLIC, PasswordHash is only needed for ACCESS_PASSWORD rooms
 type CreateRoomMessage struct {
+	Room         string
+	Capacity     int
+	Access       string
+	PasswordHash string
+	Token        string
+}
+
+// SetAccessMessage changes who can see and join a room, PasswordHash is only needed for ACCESS_PASSWORD
+type SetAccessMessage struct {
+	Room         string
+	Access       string
+	PasswordHash string
+	Token        string
+	Status       STATUS
+}
+
+// InviteMessage lets the user see and join an ACCESS_INVITE room
+type InviteMessage struct {
+	Room     string
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+type UninviteMessage struct {
 	Room     string
-	Capacity int
+	Username string
 	Token    string
+	Status   STATUS
 }
 
 type CloseRoomMessage struct {
@@ -105,26 +339,311 @@ type CloseRoomMessage struct {
 	Token string
 }
 
+type SetTopicMessage struct {
+	Room   string
+	Topic  string
+	Token  string
+	Status STATUS
+}
+
+type SetDescriptionMessage struct {
+	Room        string
+	Description string
+	Token       string
+	Status      STATUS
+}
+
+// Owners and moderators can close a room and change its settings, only the owner can hand out roles
+const (
+	ROLE_OWNER     = "owner"
+	ROLE_MODERATOR = "moderator"
+	ROLE_MEMBER    = "member"
+)
+
+// GrantRoleMessage gives one of the room's members a role, Username is the member not the one granting it
+type GrantRoleMessage struct {
+	Room     string
+	Username string
+	Role     string
+	Token    string
+	Status   STATUS
+}
+
+// RevokeRoleMessage takes the member back to being an ordinary ROLE_MEMBER
+type RevokeRoleMessage struct {
+	Room     string
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+// TransferOwnerMessage makes another member the owner of the room
+type TransferOwnerMessage struct {
+	Room     string
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+type RoomMember struct {
+	Username string
+	Online   bool
+	Role     string
+	JoinedAt time.Time
+}
+
+type ListMembersMessage struct {
+	Room    string
+	Token   string
+	Members []RoomMember
+}
+
+const (
+	MEMBER_JOINED  = "joined"
+	MEMBER_LEFT    = "left"
+	MEMBER_ONLINE  = "online"
+	MEMBER_OFFLINE = "offline"
+	MEMBER_ROLE    = "role"
+)
+
+// MemberEventMessage is pushed to a room's members when someone joins, leaves, comes online, goes offline or changes role
+// Clients only get these if they negotiated FEATURE_PRESENCE, otherwise they're sent a RECV_MSG from SERVER instead
+type MemberEventMessage struct {
+	Room   string
+	Event  string
+	Member RoomMember
+}
+
+// KickMessage takes a member out of the room, they're free to join again
+type KickMessage struct {
+	Room     string
+	Username string
+	Reason   string
+	Token    string
+	Status   STATUS
+}
+
+// BanMessage kicks the user out of the room and stops them joining again
+// Duration is in seconds, 0 bans them permanently. Expires is set in the reply, it's the zero time for permanent bans
+type BanMessage struct {
+	Room     string
+	Username string
+	Reason   string
+	Duration int
+	Expires  time.Time
+	Token    string
+	Status   STATUS
+}
+
+type UnbanMessage struct {
+	Room     string
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+// MuteMessage stops the user sending messages to the room, they still receive them
+// Duration and Expires work the same way as for a BanMessage
+type MuteMessage struct {
+	Room     string
+	Username string
+	Reason   string
+	Duration int
+	Expires  time.Time
+	Token    string
+	Status   STATUS
+}
+
+type UnmuteMessage struct {
+	Room     string
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+// The admin messages below can only be sent by server wide administrators, Username is the user being acted on
+
+// DisconnectUserMessage drops every session the user has, they're free to connect again
+type DisconnectUserMessage struct {
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+// ResetPasswordMessage sets a new password for the user, PasswordHash is hashed the same way as for REGISTER
+// Resetting a password replaces the user's token, so administrators resetting their own are sent the new one in the reply
+type ResetPasswordMessage struct {
+	Username     string
+	PasswordHash string
+	Token        string
+	Status       STATUS
+}
+
+// DeleteUserMessage removes the user from all their rooms and disconnects them, their username stays taken
+type DeleteUserMessage struct {
+	Username string
+	Token    string
+	Status   STATUS
+}
+
+type SetAdminMessage struct {
+	Username string
+	Admin    bool
+	Token    string
+	Status   STATUS
+}
+
+// SendDirectMessage sends the Message to the Recipient alone, the server fills in who sent it and when
+type SendDirectMessage struct {
+	Recipient string
+	Message   TextMessage
+	Token     string
+}
+
+// RecvDirectMessage is sent to both the sender and the recipient, the Message's Username is the sender and its Room is empty
+type RecvDirectMessage struct {
+	Recipient string
+	Message   TextMessage
+}
+
+// PopulateDirectMessages fetches the messages sent between the caller and Username, both ways
+type PopulateDirectMessages struct {
+	Username  string
+	Messages  []TextMessage
+	TimeSince int
+	Limit     int
+	Token     string
+}
+
+type DirectConversation struct {
+	Username      string
+	Messages      int
+	LastMessageAt time.Time
+}
+
+type ListDirectMessagesMessage struct {
+	Conversations []DirectConversation
+	Token         string
+}
+
+// COMMAND_CONTENTS maps each command to the type of its Contents, codecs without type information rely on it
+var COMMAND_CONTENTS = map[COMMAND]interface{}{
+	HELLO:           HelloMessage{},
+	REGISTER:        RegisterMessage{},
+	AUTHENTICATE:    AuthenticateMessage{},
+	TOKEN:           TokenMessage{},
+	LIST_ROOMS:      ListRoomsMessage{},
+	JOIN_ROOM:       JoinRoomMessage{},
+	LEAVE_ROOM:      LeaveRoomMessage{},
+	CREATE_ROOM:     CreateRoomMessage{},
+	CLOSE_ROOM:      CloseRoomMessage{},
+	SEND_MSG:        SendTextMessage{},
+	RECV_MSG:        RecvTextMessage{},
+	POP_MSGS:        PopulateMessages{},
+	ERROR:           ErrorMessage{},
+	PING:            PingMessage{},
+	PONG:            PingMessage{},
+	SERVER_SHUTDOWN: ServerShutdownMessage{},
+	LIST_MEMBERS:    ListMembersMessage{},
+	MEMBER_EVENT:    MemberEventMessage{},
+	SET_TOPIC:       SetTopicMessage{},
+	SET_DESCRIPTION: SetDescriptionMessage{},
+	GRANT_ROLE:      GrantRoleMessage{},
+	REVOKE_ROLE:     RevokeRoleMessage{},
+	TRANSFER_OWNER:  TransferOwnerMessage{},
+	DISCONNECT_USER: DisconnectUserMessage{},
+	RESET_PASSWORD:  ResetPasswordMessage{},
+	DELETE_USER:     DeleteUserMessage{},
+	SET_ADMIN:       SetAdminMessage{},
+	KICK:            KickMessage{},
+	BAN:             BanMessage{},
+	UNBAN:           UnbanMessage{},
+	MUTE:            MuteMessage{},
+	UNMUTE:          UnmuteMessage{},
+	SET_ACCESS:      SetAccessMessage{},
+	INVITE:          InviteMessage{},
+	UNINVITE:        UninviteMessage{},
+	SEND_DM:         SendDirectMessage{},
+	RECV_DM:         RecvDirectMessage{},
+	POP_DMS:         PopulateDirectMessages{},
+	LIST_DMS:        ListDirectMessagesMessage{},
+	UNREAD:          UnreadMessage{},
+	EDIT_MSG:        EditTextMessage{},
+	DELETE_MSG:      DeleteTextMessage{},
+	GET_THREAD:      GetThreadMessage{},
+}
+
 func RegisterStructs() {
 	// Register all the various subtypes of messages so gob can encode/decode them correctly
-	gob.Register(RegisterMessage{})
-	gob.Register(AuthenticateMessage{})
-	gob.Register(TokenMessage{})
 	gob.Register(TextMessage{})
-	gob.Register(SendTextMessage{})
-	gob.Register(RecvTextMessage{})
-	gob.Register(ListRoomsMessage{})
-	gob.Register(JoinRoomMessage{})
-	gob.Register(LeaveRoomMessage{})
-	gob.Register(CreateRoomMessage{})
-	gob.Register(CloseRoomMessage{})
-	gob.Register(PopulateMessages{})
+	for _, contents := range COMMAND_CONTENTS {
+		gob.Register(contents)
+	}
 }
 
-func SendRemoteCommand(encoder *gob.Encoder, message Message) error {
+func SendRemoteCommand(encoder Encoder, message Message) error {
 	return encoder.Encode(message)
 }
 
 func BuildMessage(message_type COMMAND, contents interface{}) Message {
 	return Message{Command: message_type, Contents: contents}
 }
+
+func BuildHelloMessage() Message {
+	return BuildMessage(HELLO, HelloMessage{Version: PROTOCOL_VERSION, Features: SUPPORTED_FEATURES})
+}
+
+// NegotiateHello checks a peers HELLO against what we support, returning the HELLO reply to send back
+func NegotiateHello(hello HelloMessage) HelloMessage {
+	if hello.Version < MIN_PROTOCOL_VERSION || hello.Version > PROTOCOL_VERSION {
+		return HelloMessage{
+			Version:  PROTOCOL_VERSION,
+			Features: SUPPORTED_FEATURES,
+			Status:   FAILURE,
+			Message: fmt.Sprintf("Unsupported protocol version %d (supported versions are %d -> %d)",
+				hello.Version, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION),
+		}
+	}
+
+	return HelloMessage{
+		Version:  hello.Version,
+		Features: intersectFeatures(SUPPORTED_FEATURES, hello.Features),
+		Status:   SUCCESS,
+		Message:  "Welcome!",
+	}
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, negotiated := range features {
+		if negotiated == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+func intersectFeatures(ours []string, theirs []string) []string {
+	features := []string{}
+
+	for _, feature := range ours {
+		for _, their_feature := range theirs {
+			if feature == their_feature {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+
+	return features
+}
+
+// BuildErrorMessage builds the ERROR reply to a failed command, errors that aren't a ChatError are reported as internal errors
+// Their text stays on the server, it can carry details of the database the client has no business seeing
+func BuildErrorMessage(command COMMAND, err error) Message {
+	if chatErr, ok := err.(*ChatError); ok {
+		return BuildMessage(ERROR, ErrorMessage{Code: chatErr.Code, Message: chatErr.Message, Command: command})
+	}
+
+	return BuildMessage(ERROR, ErrorMessage{Code: INTERNAL_ERROR, Message: "Internal server error", Command: command})
+}
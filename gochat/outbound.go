@@ -0,0 +1,137 @@
+package gochat
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// What to do when a connection's outbound queue is full
+	OVERFLOW_DISCONNECT  = "disconnect"
+	OVERFLOW_DROP_OLDEST = "drop_oldest"
+
+	DEFAULT_OUTBOUND_QUEUE_SIZE = 256
+)
+
+var ErrOutboundQueueClosed = errors.New("Outbound queue is closed")
+
+// OutboundConfig controls the queue of messages waiting to be written to each connection
+type OutboundConfig struct {
+	QueueSize int    `yaml:"queue_size"`
+	Overflow  string `yaml:"overflow"`
+}
+
+func (config OutboundConfig) withDefaults() (OutboundConfig, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DEFAULT_OUTBOUND_QUEUE_SIZE
+	}
+
+	switch config.Overflow {
+	case "":
+		config.Overflow = OVERFLOW_DISCONNECT
+	case OVERFLOW_DISCONNECT, OVERFLOW_DROP_OLDEST:
+	default:
+		return config, errors.New("Unknown outbound overflow policy '" + config.Overflow + "'")
+	}
+
+	return config, nil
+}
+
+// OutboundQueue is an Encoder that never blocks the caller, messages are queued and written by a goroutine per connection
+// That way one slow reader can't hold up a broadcast to everyone else in the room
+type OutboundQueue struct {
+	encoder    Encoder
+	queue      chan Message
+	overflow   string
+	disconnect func()
+	lock       sync.Mutex
+	closed     bool
+	done       chan bool
+}
+
+// NewOutboundQueue starts the writer goroutine, disconnect is called if the connection can't keep up or can't be written to
+func NewOutboundQueue(encoder Encoder, config OutboundConfig, disconnect func()) *OutboundQueue {
+	queue := &OutboundQueue{
+		encoder:    encoder,
+		queue:      make(chan Message, config.QueueSize),
+		overflow:   config.Overflow,
+		disconnect: disconnect,
+		done:       make(chan bool),
+	}
+
+	go queue.run()
+
+	return queue
+}
+
+func (queue *OutboundQueue) Encode(message Message) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed {
+		return ErrOutboundQueueClosed
+	}
+
+	select {
+	case queue.queue <- message:
+		return nil
+	default:
+	}
+
+	// The queue is full, the client isn't reading fast enough
+	if queue.overflow == OVERFLOW_DROP_OLDEST {
+		select {
+		case <-queue.queue:
+		default:
+		}
+
+		select {
+		case queue.queue <- message:
+		default:
+		}
+
+		return nil
+	}
+
+	queue.closeLocked()
+	go queue.disconnect()
+
+	return errors.New("Outbound queue is full, disconnecting the slow client")
+}
+
+// Close stops accepting messages, anything already queued is still written
+func (queue *OutboundQueue) Close() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.closeLocked()
+}
+
+func (queue *OutboundQueue) closeLocked() {
+	if !queue.closed {
+		queue.closed = true
+		close(queue.queue)
+	}
+}
+
+// Done is closed once the writer has finished with every queued message
+func (queue *OutboundQueue) Done() <-chan bool {
+	return queue.done
+}
+
+func (queue *OutboundQueue) run() {
+	defer close(queue.done)
+
+	failed := false
+	for message := range queue.queue {
+		if failed {
+			// Keep draining so the queue can be closed, there's no one to write to any more
+			continue
+		}
+
+		if err := queue.encoder.Encode(message); err != nil {
+			failed = true
+			go queue.disconnect()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package gochat
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingEncoder records what it's sent, holding up each write until it's released
+type blockingEncoder struct {
+	lock    sync.Mutex
+	written []int
+	started chan bool
+	release chan bool
+	fail    bool
+}
+
+func newBlockingEncoder() *blockingEncoder {
+	return &blockingEncoder{started: make(chan bool, 100), release: make(chan bool)}
+}
+
+func (encoder *blockingEncoder) Encode(message Message) error {
+	encoder.started <- true
+	<-encoder.release
+
+	if encoder.fail {
+		return errors.New("Write failed")
+	}
+
+	encoder.lock.Lock()
+	defer encoder.lock.Unlock()
+
+	encoder.written = append(encoder.written, message.RequestId)
+	return nil
+}
+
+func (encoder *blockingEncoder) Written() string {
+	encoder.lock.Lock()
+	defer encoder.lock.Unlock()
+
+	return fmt.Sprint(encoder.written)
+}
+
+// stall queues a first message and waits for the writer to be stuck writing it, so later ones pile up in the queue
+func stall(t *testing.T, queue *OutboundQueue, encoder *blockingEncoder) {
+	if err := queue.Encode(Message{Command: PING, RequestId: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-encoder.started:
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Timed out waiting for the writer to pick up the first message")
+	}
+}
+
+// finish lets the writer through everything queued and waits for it to stop
+func finish(t *testing.T, queue *OutboundQueue, encoder *blockingEncoder) {
+	queue.Close()
+
+	for {
+		select {
+		case encoder.release <- true:
+		case <-queue.Done():
+			return
+		case <-time.After(REPLY_TIMEOUT):
+			t.Fatal("Timed out waiting for the writer to finish")
+		}
+	}
+}
+
+func TestOutboundQueueDisconnectsWhenFull(t *testing.T) {
+	encoder := newBlockingEncoder()
+	disconnected := make(chan bool, 1)
+
+	queue := NewOutboundQueue(encoder, OutboundConfig{QueueSize: 2, Overflow: OVERFLOW_DISCONNECT}, func() { disconnected <- true })
+	stall(t, queue, encoder)
+
+	for id := 2; id <= 3; id++ {
+		if err := queue.Encode(Message{Command: PING, RequestId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := queue.Encode(Message{Command: PING, RequestId: 4}); err == nil {
+		t.Fatal("Expected a full queue to refuse the message")
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Expected a full queue to disconnect the client")
+	}
+
+	if err := queue.Encode(Message{Command: PING, RequestId: 5}); err != ErrOutboundQueueClosed {
+		t.Fatalf("Expected %v once disconnected but got %v", ErrOutboundQueueClosed, err)
+	}
+
+	// What was already queued still goes out, in order
+	finish(t, queue, encoder)
+
+	if written := encoder.Written(); written != "[1 2 3]" {
+		t.Fatalf("Expected [1 2 3] to be written but got %s", written)
+	}
+}
+
+func TestOutboundQueueDropsOldestWhenFull(t *testing.T) {
+	encoder := newBlockingEncoder()
+	disconnected := make(chan bool, 1)
+
+	queue := NewOutboundQueue(encoder, OutboundConfig{QueueSize: 2, Overflow: OVERFLOW_DROP_OLDEST}, func() { disconnected <- true })
+	stall(t, queue, encoder)
+
+	for id := 2; id <= 5; id++ {
+		if err := queue.Encode(Message{Command: PING, RequestId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	finish(t, queue, encoder)
+
+	// The one being written is safe, 2 and 3 made way for 4 and 5
+	if written := encoder.Written(); written != "[1 4 5]" {
+		t.Fatalf("Expected [1 4 5] to be written but got %s", written)
+	}
+
+	select {
+	case <-disconnected:
+		t.Fatal("Expected dropping messages not to disconnect the client")
+	default:
+	}
+}
+
+func TestOutboundQueueDisconnectsWhenWriteFails(t *testing.T) {
+	encoder := newBlockingEncoder()
+	encoder.fail = true
+	disconnected := make(chan bool, 1)
+
+	queue := NewOutboundQueue(encoder, OutboundConfig{QueueSize: 2, Overflow: OVERFLOW_DROP_OLDEST}, func() { disconnected <- true })
+	stall(t, queue, encoder)
+
+	if err := queue.Encode(Message{Command: PING, RequestId: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	encoder.release <- true
+
+	select {
+	case <-disconnected:
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Expected a failed write to disconnect the client")
+	}
+
+	// Nothing more is written once a write has failed, but the queue still drains
+	queue.Close()
+
+	select {
+	case <-queue.Done():
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Timed out waiting for the writer to finish")
+	}
+
+	if written := encoder.Written(); written != "[]" {
+		t.Fatalf("Expected nothing to be written but got %s", written)
+	}
+}
+
+func TestOutboundConfigDefaults(t *testing.T) {
+	config, err := OutboundConfig{}.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.QueueSize != DEFAULT_OUTBOUND_QUEUE_SIZE || config.Overflow != OVERFLOW_DISCONNECT {
+		t.Fatalf("Unexpected defaults %+v", config)
+	}
+
+	if _, err := (OutboundConfig{Overflow: "ignore"}).withDefaults(); err == nil {
+		t.Fatal("Expected an unknown overflow policy to be refused")
+	}
+}
@@ -3,18 +3,41 @@ package gochat
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
+// Owner isn't a column of the rooms table, it's the owner's username joined in from the users table
+// PasswordSalt and PasswordHash are only set for ACCESS_PASSWORD rooms, they're salted the same way as user passwords
 type Room struct {
-	Id       int    `db:"id"`
-	Name     string `db:"name"`
-	Capacity int    `db:"capacity"`
-	Closed   bool   `db:"closed"`
+	Id           int    `db:"id"`
+	Name         string `db:"name"`
+	Capacity     int    `db:"capacity"`
+	Closed       bool   `db:"closed"`
+	Topic        string `db:"topic"`
+	Description  string `db:"description"`
+	OwnerId      int    `db:"owner_id"`
+	Owner        string `db:"owner"`
+	CreatedAt    int64  `db:"created_at"`
+	Access       string `db:"access"`
+	PasswordSalt string `db:"password_salt"`
+	PasswordHash string `db:"password_hash"`
+}
+
+// RoomMembership is a row of the room_members table, joined with the member's username
+type RoomMembership struct {
+	Username string `db:"username"`
+	JoinedAt int64  `db:"joined_at"`
+	Role     string `db:"role"`
 }
 
 type ServerRoom struct {
-	Room  *Room
-	users []*ServerUser
+	Room     *Room
+	lock     sync.RWMutex
+	users    []*ServerUser
+	joinedAt map[*ServerUser]time.Time
+	roles    map[*ServerUser]string
+	waitlist []*ServerUser
 }
 
 func (room *ServerRoom) String() string {
@@ -25,11 +48,287 @@ func (room *ServerRoom) String() string {
 	return fmt.Sprintf("%s", room.Room.Name)
 }
 
-func (room *ServerRoom) AddUser(user *ServerUser) error {
+// AddUser adds the user to the room, returning false if they were already in it
+// It returns ErrRoomIsFull if the room is at capacity
+func (room *ServerRoom) AddUser(user *ServerUser) (bool, error) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	if room.hasUserLocked(user) {
+		return false, nil
+	}
+
+	if room.isFullLocked() {
+		return false, ErrRoomIsFull
+	}
+
+	room.addUserLocked(user, time.Now(), ROLE_MEMBER)
+	return true, nil
+}
+
+func (room *ServerRoom) addUserLocked(user *ServerUser, joinedAt time.Time, role string) {
+	if room.joinedAt == nil {
+		room.joinedAt = make(map[*ServerUser]time.Time)
+		room.roles = make(map[*ServerUser]string)
+	}
+
 	room.users = append(room.users, user)
+	room.joinedAt[user] = joinedAt
+	room.roles[user] = role
+}
+
+// Role returns the user's role in the room, the owner is always ROLE_OWNER and non-members have no role
+func (room *ServerRoom) Role(user *ServerUser) string {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	if room.isOwnerLocked(user) {
+		return ROLE_OWNER
+	}
+
+	return room.roles[user]
+}
+
+func (room *ServerRoom) setRole(user *ServerUser, role string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	if room.hasUserLocked(user) {
+		room.roles[user] = role
+	}
+}
+
+// JoinedAt returns when the user became a member of the room
+func (room *ServerRoom) JoinedAt(user *ServerUser) time.Time {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.joinedAt[user]
+}
+
+// Member describes the user as a member of the room, whether or not they still are one
+func (room *ServerRoom) Member(user *ServerUser) RoomMember {
+	return RoomMember{
+		Username: user.User.Username,
+		Online:   user.Online(),
+		Role:     room.Role(user),
+		JoinedAt: room.JoinedAt(user),
+	}
+}
+
+// Members returns every member of the room in the order they joined
+func (room *ServerRoom) Members() []RoomMember {
+	users := room.Users()
+	members := make([]RoomMember, len(users))
+
+	for i, user := range users {
+		members[i] = room.Member(user)
+	}
+
+	return members
+}
+
+// Info describes the room as it is right now
+func (room *ServerRoom) Info() RoomInfo {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	info := RoomInfo{
+		Name:        room.Room.Name,
+		Topic:       room.Room.Topic,
+		Description: room.Room.Description,
+		Owner:       room.Room.Owner,
+		Capacity:    room.Room.Capacity,
+		Access:      room.accessLocked(),
+		Members:     len(room.users),
+	}
+
+	// Rooms created before we recorded it have no creation time
+	if room.Room.CreatedAt > 0 {
+		info.CreatedAt = time.Unix(room.Room.CreatedAt, 0)
+	}
+
+	for _, user := range room.users {
+		if user.Online() {
+			info.Online++
+		}
+	}
+
+	return info
+}
+
+// Access returns who is allowed to see and join the room, one of the ACCESS_* modes
+func (room *ServerRoom) Access() string {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.accessLocked()
+}
+
+// Rooms from before access modes were added are all public
+func (room *ServerRoom) accessLocked() string {
+	if room.Room.Access == "" {
+		return ACCESS_PUBLIC
+	}
+
+	return room.Room.Access
+}
+
+// password returns the room's salt and salted password hash
+func (room *ServerRoom) password() (string, string) {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.Room.PasswordSalt, room.Room.PasswordHash
+}
+
+func (room *ServerRoom) setAccess(access string, salt string, password_hash string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.Room.Access = access
+	room.Room.PasswordSalt = salt
+	room.Room.PasswordHash = password_hash
+}
+
+// IsOwner reports whether the user owns the room
+func (room *ServerRoom) IsOwner(user *ServerUser) bool {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.isOwnerLocked(user)
+}
+
+func (room *ServerRoom) isOwnerLocked(user *ServerUser) bool {
+	return room.Room.OwnerId != 0 && room.Room.OwnerId == user.User.Id
+}
+
+// Owner returns the member who owns the room, or nil if the owner isn't a member
+func (room *ServerRoom) Owner() *ServerUser {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	for _, user := range room.users {
+		if room.isOwnerLocked(user) {
+			return user
+		}
+	}
+
 	return nil
 }
 
+// HasOwner is false for rooms created before owners were recorded
+func (room *ServerRoom) HasOwner() bool {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.Room.OwnerId != 0
+}
+
+func (room *ServerRoom) setOwner(user *ServerUser) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.Room.OwnerId = user.User.Id
+	room.Room.Owner = user.User.Username
+}
+
+func (room *ServerRoom) setTopic(topic string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.Room.Topic = topic
+}
+
+func (room *ServerRoom) setDescription(description string) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	room.Room.Description = description
+}
+
+// A Capacity of 0 or less means the room has no limit
+func (room *ServerRoom) isFullLocked() bool {
+	return room.Room.Capacity > 0 && len(room.users) >= room.Room.Capacity
+}
+
+// Waitlist queues the user for the next free space, returning their position in the queue (starting at 1)
+func (room *ServerRoom) Waitlist(user *ServerUser) int {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	for i, waiting := range room.waitlist {
+		if waiting == user {
+			return i + 1
+		}
+	}
+
+	room.waitlist = append(room.waitlist, user)
+	return len(room.waitlist)
+}
+
+// RemoveFromWaitlist takes the user out of the queue, returning false if they weren't waiting
+func (room *ServerRoom) RemoveFromWaitlist(user *ServerUser) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	waitlist, err := removeUserFromList(user, room.waitlist)
+	if err != nil {
+		return false
+	}
+
+	room.waitlist = waitlist
+	return true
+}
+
+// AdmitFromWaitlist moves waiting users into the room while there's space, returning the users let in
+func (room *ServerRoom) AdmitFromWaitlist() []*ServerUser {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
+	var admitted []*ServerUser
+
+	for len(room.waitlist) > 0 && !room.isFullLocked() {
+		user := room.waitlist[0]
+		room.waitlist = room.waitlist[1:]
+
+		if !room.hasUserLocked(user) {
+			room.addUserLocked(user, time.Now(), ROLE_MEMBER)
+			admitted = append(admitted, user)
+		}
+	}
+
+	return admitted
+}
+
+func (room *ServerRoom) HasUser(user *ServerUser) bool {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	return room.hasUserLocked(user)
+}
+
+func (room *ServerRoom) hasUserLocked(user *ServerUser) bool {
+	for _, room_user := range room.users {
+		if room_user == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Users returns a snapshot of the users in the room, safe to range over while others join and leave
+func (room *ServerRoom) Users() []*ServerUser {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+
+	users := make([]*ServerUser, len(room.users))
+	copy(users, room.users)
+
+	return users
+}
+
 func removeUserFromList(user *ServerUser, array []*ServerUser) ([]*ServerUser, error) {
 	index := -1
 	for i, room_user := range array {
@@ -46,12 +345,17 @@ func removeUserFromList(user *ServerUser, array []*ServerUser) ([]*ServerUser, e
 }
 
 func (room *ServerRoom) RemoveUser(user *ServerUser) error {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+
 	array, err := removeUserFromList(user, room.users)
 	if err != nil {
 		return err
 	}
 
 	room.users = array
+	delete(room.joinedAt, user)
+	delete(room.roles, user)
 
 	return nil
 }
@@ -2,31 +2,126 @@ package gochat
 
 import (
 	"errors"
+	"sort"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
 )
 
 const (
-	CREATE_ROOM_SQL   = "INSERT INTO rooms (name, capacity, closed) VALUES (?, ?, ?)"
-	GET_ALL_ROOMS_SQL = "SELECT * FROM rooms WHERE closed=?"
-	DELETE_ROOM_SQL   = "DELETE FROM rooms WHERE name=?"
-	GET_ROOM_SQL      = "SELECT * FROM rooms WHERE name=?"
-	ROOM_SCHEMA       = `
+	CREATE_ROOM_SQL     = "INSERT INTO rooms (name, capacity, closed, topic, description, owner_id, created_at, access, password_salt, password_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	DELETE_ROOM_SQL     = "DELETE FROM rooms WHERE name=?"
+	SET_TOPIC_SQL       = "UPDATE rooms SET topic=? WHERE id=?"
+	SET_DESCRIPTION_SQL = "UPDATE rooms SET description=? WHERE id=?"
+	SET_OWNER_SQL       = "UPDATE rooms SET owner_id=? WHERE id=?"
+	SET_ACCESS_SQL      = "UPDATE rooms SET access=?, password_salt=?, password_hash=? WHERE id=?"
+	SELECT_ROOMS_SQL    = "SELECT r.*, COALESCE(u.username, '') AS owner FROM rooms AS r LEFT JOIN users AS u ON (r.owner_id = u.id)"
+	GET_ALL_ROOMS_SQL   = SELECT_ROOMS_SQL + " WHERE r.closed=?"
+	GET_ROOM_SQL        = SELECT_ROOMS_SQL + " WHERE r.name=?"
+	ROOM_SCHEMA         = `
 	CREATE TABLE IF NOT EXISTS rooms (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT UNIQUE,
 		capacity INTEGER,
-		closed BOOLEAN
+		closed BOOLEAN,
+		topic TEXT DEFAULT '',
+		description TEXT DEFAULT '',
+		owner_id INTEGER DEFAULT 0,
+		created_at INT DEFAULT 0,
+		access TEXT DEFAULT 'public',
+		password_salt TEXT DEFAULT '',
+		password_hash TEXT DEFAULT ''
 	)`
 )
 
+// ROOM_COLUMNS were added to the rooms table after it was first released, older DBs are given them on startup
+var ROOM_COLUMNS = [][2]string{
+	{"topic", "TEXT DEFAULT ''"},
+	{"description", "TEXT DEFAULT ''"},
+	{"owner_id", "INTEGER DEFAULT 0"},
+	{"created_at", "INT DEFAULT 0"},
+	{"access", "TEXT DEFAULT 'public'"},
+	{"password_salt", "TEXT DEFAULT ''"},
+	{"password_hash", "TEXT DEFAULT ''"},
+}
+
+const (
+	ADD_MEMBER_SQL         = "INSERT INTO room_members (room_id, user_id, joined_at) VALUES (?, ?, ?)"
+	REMOVE_MEMBER_SQL      = "DELETE FROM room_members WHERE room_id=? AND user_id=?"
+	REMOVE_ALL_MEMBERS_SQL = "DELETE FROM room_members WHERE room_id=?"
+	SET_MEMBER_ROLE_SQL    = "UPDATE room_members SET role=? WHERE room_id=? AND user_id=?"
+	SET_LAST_READ_SQL      = "UPDATE room_members SET last_read_id=? WHERE room_id=? AND user_id IN (?) AND last_read_id<?"
+	GET_LAST_READ_SQL      = "SELECT last_read_id FROM room_members WHERE room_id=? AND user_id=?"
+	GET_ROOM_MEMBERS_SQL   = `
+	SELECT
+		u.username AS username,
+		rm.joined_at AS joined_at,
+		rm.role AS role
+	FROM
+		room_members AS rm
+	JOIN
+		users AS u ON (rm.user_id = u.id)
+	WHERE
+		rm.room_id=?
+		AND u.deleted=?
+	ORDER BY
+		rm.joined_at
+	`
+	GET_USER_ROOMS_SQL = `
+	SELECT
+		r.name
+	FROM
+		room_members AS rm
+	JOIN
+		rooms AS r ON (rm.room_id = r.id)
+	WHERE
+		rm.user_id=?
+		AND r.closed=?
+	ORDER BY
+		r.name
+	`
+	ROOM_MEMBERS_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS room_members (
+		room_id INTEGER,
+		user_id INTEGER,
+		joined_at INT,
+		role TEXT DEFAULT 'member',
+		last_read_id INTEGER DEFAULT 0,
+		PRIMARY KEY (room_id, user_id)
+	)`
+)
+
+const (
+	ADD_INVITE_SQL     = "INSERT INTO room_invites (room_id, user_id, actor_id, created_at) VALUES (?, ?, ?, ?)"
+	REMOVE_INVITE_SQL  = "DELETE FROM room_invites WHERE room_id=? AND user_id=?"
+	INVITE_EXISTS_SQL  = "SELECT COUNT(*) FROM room_invites WHERE room_id=? AND user_id=?"
+	ROOM_INVITE_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS room_invites (
+		room_id INTEGER,
+		user_id INTEGER,
+		actor_id INTEGER,
+		created_at INT,
+		PRIMARY KEY (room_id, user_id)
+	)`
+)
+
+var (
+	ErrRoomDoesNotExist = NewChatError(ROOM_NOT_FOUND, "Room doesn't exist")
+	ErrRoomIsClosed     = NewChatError(ROOM_CLOSED, "Room is closed.")
+	ErrRoomIsFull       = NewChatError(ROOM_FULL, "Room is full.")
+)
+
 type RoomManager struct {
-	storage   *StorageManager
-	logger    *log.Entry
-	roomCache map[string]*ServerRoom
+	storage     *StorageManager
+	userManager *UserManager
+	logger      *log.Entry
+	lock        sync.RWMutex
+	roomCache   map[string]*ServerRoom
 }
 
-func NewRoomManager(storage *StorageManager, logger *log.Entry) (*RoomManager, error) {
+func NewRoomManager(storage *StorageManager, userManager *UserManager, logger *log.Entry) (*RoomManager, error) {
 	// Create the rooms table if it doesn't already exist
 	_, err := storage.db.Exec(ROOM_SCHEMA)
 	if err != nil {
@@ -34,10 +129,42 @@ func NewRoomManager(storage *StorageManager, logger *log.Entry) (*RoomManager, e
 		return &RoomManager{}, errors.New("Failed to generate the Room schema.")
 	}
 
+	for _, column := range ROOM_COLUMNS {
+		if err := storage.AddColumnIfMissing("rooms", column[0], column[1]); err != nil {
+			logger.Error(err)
+			return &RoomManager{}, errors.New("Failed to add the " + column[0] + " column to the Room schema.")
+		}
+	}
+
+	// Create the room_members table if it doesn't already exist
+	_, err = storage.db.Exec(ROOM_MEMBERS_SCHEMA)
+	if err != nil {
+		logger.Error(err)
+		return &RoomManager{}, errors.New("Failed to generate the room members schema.")
+	}
+
+	if err := storage.AddColumnIfMissing("room_members", "role", "TEXT DEFAULT 'member'"); err != nil {
+		logger.Error(err)
+		return &RoomManager{}, errors.New("Failed to add the role column to the room members schema.")
+	}
+
+	if err := storage.AddColumnIfMissing("room_members", "last_read_id", "INTEGER DEFAULT 0"); err != nil {
+		logger.Error(err)
+		return &RoomManager{}, errors.New("Failed to add the last_read_id column to the room members schema.")
+	}
+
+	// Create the room_invites table if it doesn't already exist
+	_, err = storage.db.Exec(ROOM_INVITE_SCHEMA)
+	if err != nil {
+		logger.Error(err)
+		return &RoomManager{}, errors.New("Failed to generate the room invites schema.")
+	}
+
 	manager := RoomManager{
-		storage:   storage,
-		logger:    logger,
-		roomCache: make(map[string]*ServerRoom),
+		storage:     storage,
+		userManager: userManager,
+		logger:      logger,
+		roomCache:   make(map[string]*ServerRoom),
 	}
 
 	if err := manager.LoadRooms(); err != nil {
@@ -50,9 +177,15 @@ func NewRoomManager(storage *StorageManager, logger *log.Entry) (*RoomManager, e
 
 func (manager *RoomManager) GetRoom(name string) (*ServerRoom, error) {
 	// If the Room has already been extracted from storage, just return them
-	if room, ok := manager.roomCache[name]; ok {
-		if room.Room.Closed {
-			return nil, errors.New("Room is closed.")
+	// CloseRoom marks rooms as closed under the lock, so check it before letting go
+	manager.lock.RLock()
+	room, ok := manager.roomCache[name]
+	closed := ok && room.Room.Closed
+	manager.lock.RUnlock()
+
+	if ok {
+		if closed {
+			return nil, ErrRoomIsClosed
 		}
 
 		return room, nil
@@ -61,25 +194,39 @@ func (manager *RoomManager) GetRoom(name string) (*ServerRoom, error) {
 	// Otherwise extract the Room from storage, putting it into the cache as well
 	var dbRoom Room
 
-	if err := manager.storage.db.Get(&dbRoom, GET_ROOM_SQL, name); err != nil {
+	sql := manager.storage.db.Rebind(GET_ROOM_SQL)
+	if err := manager.storage.db.Get(&dbRoom, sql, name); err != nil {
 		if err.Error() == "sql: no rows in result set" {
-			return &ServerRoom{}, errors.New("Room doesn't exist")
+			return &ServerRoom{}, ErrRoomDoesNotExist
 		}
 
 		manager.logger.Error(err)
 		return &ServerRoom{}, err
 	}
 
-	room := ServerRoom{Room: &dbRoom}
+	loaded, err := manager.loadRoom(&dbRoom)
+	if err != nil {
+		return &ServerRoom{}, err
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
 
-	// Add the Room to the cache regardless of if it's closed or not
-	manager.roomCache[name] = &room
+	// Someone else may have loaded it while we were talking to the DB, everyone must share the one ServerRoom
+	if cached, ok := manager.roomCache[name]; ok {
+		room = cached
+	} else {
+		room = loaded
+
+		// Add the Room to the cache regardless of if it's closed or not
+		manager.roomCache[name] = room
+	}
 
 	if room.Room.Closed {
-		return &ServerRoom{}, errors.New("Room is closed.")
+		return &ServerRoom{}, ErrRoomIsClosed
 	}
 
-	return &room, nil
+	return room, nil
 }
 
 func (manager *RoomManager) LoadRooms() error {
@@ -90,41 +237,215 @@ func (manager *RoomManager) LoadRooms() error {
 		return errors.New("Failed to run GET_ALL_ROOMS_SQL")
 	}
 
+	var dbRooms []*Room
+
 	for rows.Next() {
 		var dbRoom Room
 		err = rows.StructScan(&dbRoom)
 		if err != nil {
+			rows.Close()
 			manager.logger.Error(err)
 			return errors.New("Failed to parse a GET_ALL_ROOMS_SQL result into a dbRoom")
 		}
 
-		room := ServerRoom{Room: &dbRoom}
-		manager.roomCache[dbRoom.Name] = &room
+		dbRooms = append(dbRooms, &dbRoom)
+	}
+
+	// Finish with the rows before loading the members, SQLite only gives us the one connection
+	rows.Close()
+
+	for _, dbRoom := range dbRooms {
+		room, err := manager.loadRoom(dbRoom)
+		if err != nil {
+			return err
+		}
+
+		manager.lock.Lock()
+		manager.roomCache[dbRoom.Name] = room
+		manager.lock.Unlock()
 	}
 
 	return nil
 }
 
-func (manager *RoomManager) GetRoomNames() []string {
-	rooms := make([]string, len(manager.roomCache))
+// loadRoom builds the ServerRoom for a room from the DB, filling in its members
+func (manager *RoomManager) loadRoom(dbRoom *Room) (*ServerRoom, error) {
+	room := &ServerRoom{Room: dbRoom}
+
+	var memberships []RoomMembership
 
-	// key is the name of the room here
-	var i int
-	for key := range manager.roomCache {
-		rooms[i] = key
-		i++
+	sql := manager.storage.db.Rebind(GET_ROOM_MEMBERS_SQL)
+	if err := manager.storage.db.Select(&memberships, sql, dbRoom.Id, false); err != nil {
+		manager.logger.Error(err)
+		return room, errors.New("Failed to run GET_ROOM_MEMBERS_SQL")
 	}
 
-	if len(rooms) == 0 {
-		rooms = append(rooms, "There are no rooms!")
+	for _, membership := range memberships {
+		user, err := manager.userManager.GetUser(membership.Username)
+		if err != nil {
+			manager.logger.Error(err)
+			return room, errors.New("Failed to load member '" + membership.Username + "' of room " + dbRoom.Name)
+		}
+
+		room.addUserLocked(user, time.Unix(membership.JoinedAt, 0), membership.Role)
+	}
+
+	return room, nil
+}
+
+// GetRooms returns every open room, sorted by name
+func (manager *RoomManager) GetRooms() []*ServerRoom {
+	manager.lock.RLock()
+	rooms := make([]*ServerRoom, 0, len(manager.roomCache))
+	for _, room := range manager.roomCache {
+		rooms = append(rooms, room)
 	}
+	manager.lock.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].String() < rooms[j].String() })
 
 	return rooms
 }
 
-func (manager *RoomManager) CreateRoom(name string, capacity int) (*ServerRoom, error) {
+// SetTopic changes the room's topic, both in the DB and on the room itself
+func (manager *RoomManager) SetTopic(room *ServerRoom, topic string) error {
+	sql := manager.storage.db.Rebind(SET_TOPIC_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, topic, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_TOPIC_SQL")
+	}
+
+	room.setTopic(topic)
+	return nil
+}
+
+// SetDescription changes the room's description, both in the DB and on the room itself
+func (manager *RoomManager) SetDescription(room *ServerRoom, description string) error {
+	sql := manager.storage.db.Rebind(SET_DESCRIPTION_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, description, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_DESCRIPTION_SQL")
+	}
+
+	room.setDescription(description)
+	return nil
+}
+
+// SetRole changes a member's role in the room, both in the DB and on the room itself
+func (manager *RoomManager) SetRole(room *ServerRoom, user *ServerUser, role string) error {
+	sql := manager.storage.db.Rebind(SET_MEMBER_ROLE_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, role, room.Room.Id, user.User.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_MEMBER_ROLE_SQL")
+	}
+
+	room.setRole(user, role)
+	return nil
+}
+
+// TransferOwnership hands the room to another member, the previous owner stays on as a moderator
+func (manager *RoomManager) TransferOwnership(room *ServerRoom, owner *ServerUser, previous *ServerUser) error {
+	sql := manager.storage.db.Rebind(SET_OWNER_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, owner.User.Id, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_OWNER_SQL")
+	}
+
+	room.setOwner(owner)
+
+	if previous != nil && previous != owner && room.HasUser(previous) {
+		return manager.SetRole(room, previous, ROLE_MODERATOR)
+	}
+
+	return nil
+}
+
+// hashRoomPassword salts the password for ACCESS_PASSWORD rooms, other rooms don't keep one
+func hashRoomPassword(access string, password string) (string, string, error) {
+	if access != ACCESS_PASSWORD {
+		return "", "", nil
+	}
+
+	return hashPassword(password)
+}
+
+// SetAccess changes who can see and join the room, password is only used by ACCESS_PASSWORD rooms
+func (manager *RoomManager) SetAccess(room *ServerRoom, access string, password string) error {
+	salt, password_hash, err := hashRoomPassword(access, password)
+	if err != nil {
+		return err
+	}
+
+	sql := manager.storage.db.Rebind(SET_ACCESS_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, access, salt, password_hash, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_ACCESS_SQL")
+	}
+
+	room.setAccess(access, salt, password_hash)
+	return nil
+}
+
+// CheckPassword reports whether the password lets people into the room
+func (manager *RoomManager) CheckPassword(room *ServerRoom, password string) (bool, error) {
+	salt, password_hash := room.password()
+	return passwordMatches(salt, password_hash, password)
+}
+
+// AddInvite lets the user into an ACCESS_INVITE room, inviting someone twice does nothing
+func (manager *RoomManager) AddInvite(room *ServerRoom, user *ServerUser, actor *ServerUser) error {
+	invited, err := manager.IsInvited(room, user)
+	if err != nil || invited {
+		return err
+	}
+
+	sql := manager.storage.db.Rebind(ADD_INVITE_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, room.Room.Id, user.User.Id, actor.User.Id, time.Now().Unix())); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run ADD_INVITE_SQL")
+	}
+
+	return nil
+}
+
+// RemoveInvite takes back the user's invite, returning false if they didn't have one
+func (manager *RoomManager) RemoveInvite(room *ServerRoom, user *ServerUser) (bool, error) {
+	sql := manager.storage.db.Rebind(REMOVE_INVITE_SQL)
+	result, err := manager.storage.db.Exec(sql, room.Room.Id, user.User.Id)
+	if err != nil {
+		manager.logger.Error(err)
+		return false, errors.New("Failed to run REMOVE_INVITE_SQL")
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return removed > 0, nil
+}
+
+func (manager *RoomManager) IsInvited(room *ServerRoom, user *ServerUser) (bool, error) {
+	var count int
+
+	sql := manager.storage.db.Rebind(INVITE_EXISTS_SQL)
+	if err := manager.storage.db.Get(&count, sql, room.Room.Id, user.User.Id); err != nil {
+		manager.logger.Error(err)
+		return false, errors.New("Failed to run INVITE_EXISTS_SQL")
+	}
+
+	return count > 0, nil
+}
+
+// CreateRoom makes a new room owned by the user creating it, password is only used by ACCESS_PASSWORD rooms
+func (manager *RoomManager) CreateRoom(name string, capacity int, access string, password string, owner *ServerUser) (*ServerRoom, error) {
+	salt, password_hash, err := hashRoomPassword(access, password)
+	if err != nil {
+		return &ServerRoom{}, err
+	}
+
 	sql := manager.storage.db.Rebind(CREATE_ROOM_SQL)
-	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, name, capacity, false)); err != nil {
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, name, capacity, false, "", "", owner.User.Id, time.Now().Unix(), access, salt, password_hash)); err != nil {
 		manager.logger.Error(err)
 		return &ServerRoom{}, errors.New("Failed to run CREATE_ROOM_SQL")
 	}
@@ -135,9 +456,6 @@ func (manager *RoomManager) CreateRoom(name string, capacity int) (*ServerRoom,
 		return &ServerRoom{}, errors.New("Failed to get room after creation.")
 	}
 
-	// Add them into the cache as well
-	manager.roomCache[room.Room.Name] = room
-
 	return room, nil
 }
 
@@ -149,13 +467,148 @@ func (manager *RoomManager) CloseRoom(name string) (*ServerRoom, error) {
 		return &ServerRoom{}, errors.New("Failed to get the room from the DB")
 	}
 
-	// Remove the room from the cache
+	// Remove the room from the cache and mark the room as closed on the object
+	manager.lock.Lock()
 	delete(manager.roomCache, name)
-
-	// Mark the room as closed on the object
 	room.Room.Closed = true
+	manager.lock.Unlock()
 
 	// Mark the room as closed in the db
 	sql := manager.storage.db.Rebind(DELETE_ROOM_SQL)
-	return room, manager.storage.ExecOneRow(manager.storage.db.Exec(sql, name))
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, name)); err != nil {
+		return room, err
+	}
+
+	// Nobody is a member of a closed room
+	sql = manager.storage.db.Rebind(REMOVE_ALL_MEMBERS_SQL)
+	return room, manager.storage.ExecZeroOrMoreRows(manager.storage.db.Exec(sql, room.Room.Id))
+}
+
+// AddMember puts the user in the room until they leave it, returning false if they were already a member
+func (manager *RoomManager) AddMember(room *ServerRoom, user *ServerUser) (bool, error) {
+	added, err := room.AddUser(user)
+	if err != nil || !added {
+		return false, err
+	}
+
+	sql := manager.storage.db.Rebind(ADD_MEMBER_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, room.Room.Id, user.User.Id, room.JoinedAt(user).Unix())); err != nil {
+		// Don't let them in if we can't remember that they're in
+		room.RemoveUser(user)
+		manager.logger.Error(err)
+		return false, errors.New("Failed to run ADD_MEMBER_SQL")
+	}
+
+	return true, nil
+}
+
+// RemoveMember takes the user out of the room, returning an error if they weren't a member
+func (manager *RoomManager) RemoveMember(room *ServerRoom, user *ServerUser) error {
+	if err := room.RemoveUser(user); err != nil {
+		return err
+	}
+
+	sql := manager.storage.db.Rebind(REMOVE_MEMBER_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, room.Room.Id, user.User.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run REMOVE_MEMBER_SQL")
+	}
+
+	return nil
+}
+
+// MarkRead moves the members' last-read markers up to the message in one statement, they never move backwards
+func (manager *RoomManager) MarkRead(room *ServerRoom, messageId int64, users ...*ServerUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	userIds := make([]int, 0, len(users))
+	for _, user := range users {
+		userIds = append(userIds, user.User.Id)
+	}
+
+	sql, args, err := sqlx.In(SET_LAST_READ_SQL, messageId, room.Room.Id, userIds, messageId)
+	if err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to build SET_LAST_READ_SQL")
+	}
+
+	sql = manager.storage.db.Rebind(sql)
+	if err := manager.storage.ExecZeroOrMoreRows(manager.storage.db.Exec(sql, args...)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run SET_LAST_READ_SQL")
+	}
+
+	return nil
+}
+
+// GetLastRead returns the ID of the last message the member has read in the room, 0 if they haven't read any yet
+func (manager *RoomManager) GetLastRead(room *ServerRoom, user *ServerUser) (int64, error) {
+	var lastRead int64
+
+	sql := manager.storage.db.Rebind(GET_LAST_READ_SQL)
+	if err := manager.storage.db.Get(&lastRead, sql, room.Room.Id, user.User.Id); err != nil {
+		manager.logger.Error(err)
+		return 0, errors.New("Failed to run GET_LAST_READ_SQL")
+	}
+
+	return lastRead, nil
+}
+
+// AdmitFromWaitlist makes members of anyone waiting for the space(s) in the room, returning the users let in
+func (manager *RoomManager) AdmitFromWaitlist(room *ServerRoom) []*ServerUser {
+	var admitted []*ServerUser
+
+	for _, user := range room.AdmitFromWaitlist() {
+		sql := manager.storage.db.Rebind(ADD_MEMBER_SQL)
+		if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, room.Room.Id, user.User.Id, room.JoinedAt(user).Unix())); err != nil {
+			room.RemoveUser(user)
+			manager.logger.Error(err)
+			continue
+		}
+
+		admitted = append(admitted, user)
+	}
+
+	return admitted
+}
+
+// GetUserRoomNames returns the names of the open rooms the user is a member of
+func (manager *RoomManager) GetUserRoomNames(user *ServerUser) ([]string, error) {
+	var names []string
+
+	sql := manager.storage.db.Rebind(GET_USER_ROOMS_SQL)
+	if err := manager.storage.db.Select(&names, sql, user.User.Id, false); err != nil {
+		manager.logger.Error(err)
+		return names, errors.New("Failed to run GET_USER_ROOMS_SQL")
+	}
+
+	return names, nil
+}
+
+// GetUserRooms returns the loaded rooms the user is a member of
+func (manager *RoomManager) GetUserRooms(user *ServerUser) []*ServerRoom {
+	var rooms []*ServerRoom
+
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	for _, room := range manager.roomCache {
+		if room.HasUser(user) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms
+}
+
+// RemoveFromWaitlists takes the user out of every waitlist they're in, places in the queue don't outlive the user's sessions
+func (manager *RoomManager) RemoveFromWaitlists(user *ServerUser) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	for _, room := range manager.roomCache {
+		room.RemoveFromWaitlist(user)
+	}
 }
@@ -0,0 +1,779 @@
+package gochat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestRoomCapacityAndWaitlist(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildCreateRoomMessage("support", 1)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildJoinRoomMessage("support")
+	if _, err := alice.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room is full, so bob is turned away
+	message, _ = bob.BuildJoinRoomMessage("support")
+	reply, err := bob.expect(message, ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := reply.Contents.(ErrorMessage).Code; code != ROOM_FULL {
+		t.Fatalf("Expected %s when joining a full room, got %s", ROOM_FULL, code)
+	}
+
+	// Unless he's willing to wait
+	message, _ = bob.BuildWaitlistRoomMessage("support")
+	reply, err = bob.expect(message, JOIN_ROOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := reply.Contents.(JoinRoomMessage).Status; status != WAITLISTED {
+		t.Fatalf("Expected to be waitlisted, got '%s'", status)
+	}
+
+	// Alice leaving makes space, bob is let in and told about it
+	message, _ = alice.BuildLeaveRoomMessage("support")
+	if _, err := alice.expect(message, LEAVE_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, err := bob.waitForCommand(JOIN_ROOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contents := pushed.Contents.(JoinRoomMessage); contents.Status != SUCCESS || contents.Room != "support" {
+		t.Fatalf("Expected bob to be admitted to support, got %+v", contents)
+	}
+
+	// And now alice is the one who can't get in
+	message, _ = alice.BuildJoinRoomMessage("support")
+	if _, err := alice.expect(message, ERROR); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoomMembershipOutlivesSessionsAndRestarts(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gochat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	database := filepath.Join(directory, "gochat.db")
+	server, address := startTestServerWithDatabase(t, database)
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, roomName := range []string{"lobby", "support"} {
+		message, _ := alice.BuildCreateRoomMessage(roomName, 10)
+		if _, err := alice.expect(message, RECV_MSG); err != nil {
+			t.Fatal(err)
+		}
+
+		message, _ = alice.BuildJoinRoomMessage(roomName)
+		if _, err := alice.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message, _ := alice.BuildLeaveRoomMessage("support")
+	if _, err := alice.expect(message, LEAVE_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.Close()
+
+	// Disconnecting isn't leaving
+	alice, err = connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, err := alice.authenticateForRooms("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Fatalf("Expected alice to still be in lobby after reconnecting, she is in %v", rooms)
+	}
+
+	alice.Close()
+	server.Shutdown()
+
+	// Neither is the server restarting
+	server, address = startTestServerWithDatabase(t, database)
+	defer server.Shutdown()
+
+	alice, err = connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	rooms, err = alice.authenticateForRooms("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Fatalf("Expected alice to still be in lobby after a restart, she is in %v", rooms)
+	}
+
+	// She gets the room's messages without having to join again
+	message, _ = alice.BuildSendMessageMessage("back again", "lobby")
+	if err := SendRemoteCommand(alice.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.waitForText("alice", "back again"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoomMembersAndPresence(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := bob.BuildCreateRoomMessage("oncall", 10)
+	if _, err := bob.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildJoinRoomMessage("oncall")
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildJoinRoomMessage("oncall")
+	if _, err := alice.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.waitForMemberEvent("alice", MEMBER_JOINED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildListMembersMessage("oncall")
+	reply, err := bob.expect(message, LIST_MEMBERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := reply.Contents.(ListMembersMessage).Members
+	if len(members) != 2 || members[0].Username != "bob" || members[1].Username != "alice" {
+		t.Fatalf("Expected bob then alice to be members, got %+v", members)
+	}
+
+	for _, member := range members {
+		if !member.Online || member.JoinedAt.IsZero() {
+			t.Fatalf("Expected an online member with a join time, got %+v", member)
+		}
+	}
+
+	if members[0].Role != ROLE_OWNER || members[1].Role != ROLE_MEMBER {
+		t.Fatalf("Expected bob to own the room he created and alice to be a member, got %+v", members)
+	}
+
+	// Alice disconnecting leaves her a member, just not a present one
+	alice.Close()
+
+	if err := bob.waitForMemberEvent("alice", MEMBER_OFFLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildListMembersMessage("oncall")
+	reply, err = bob.expect(message, LIST_MEMBERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members = reply.Contents.(ListMembersMessage).Members
+	if len(members) != 2 || members[1].Online {
+		t.Fatalf("Expected alice to be listed as offline, got %+v", members)
+	}
+}
+
+func TestRoomInfoAndSettings(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildListRoomsMessage()
+	reply, err := alice.expect(message, LIST_ROOMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rooms := reply.Contents.(ListRoomsMessage).RoomInfos; len(rooms) != 0 {
+		t.Fatalf("Expected no rooms, got %+v", rooms)
+	}
+
+	message, _ = alice.BuildCreateRoomMessage("support", 5)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		message, _ := client.BuildJoinRoomMessage("support")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message, _ = alice.BuildSetTopicMessage("support", "Sev 2 incident")
+	if _, err := alice.expect(message, SET_TOPIC); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildSetDescriptionMessage("support", "Where the on-call engineer hangs out")
+	if _, err := alice.expect(message, SET_DESCRIPTION); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ordinary members don't get to change them
+	message, _ = bob.BuildSetTopicMessage("support", "Nothing to see here")
+	reply, err = bob.expect(message, ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := reply.Contents.(ErrorMessage).Code; code != PERMISSION_DENIED {
+		t.Fatalf("Expected %s when a member sets the topic, got %s", PERMISSION_DENIED, code)
+	}
+
+	message, _ = bob.BuildListRoomsMessage()
+	reply, err = bob.expect(message, LIST_ROOMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rooms := reply.Contents.(ListRoomsMessage).RoomInfos
+	if len(rooms) != 1 {
+		t.Fatalf("Expected a single room, got %+v", rooms)
+	}
+
+	room := rooms[0]
+	if room.Name != "support" || room.Topic != "Sev 2 incident" || room.Description != "Where the on-call engineer hangs out" ||
+		room.Owner != "alice" || room.CreatedAt.IsZero() || room.Capacity != 5 || room.Members != 2 || room.Online != 2 {
+		t.Fatalf("Unexpected room info %+v", room)
+	}
+}
+
+func TestRoomListingForVersion1Clients(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClientWithHello(address, HelloMessage{Version: 1, Features: SUPPORTED_FEATURES})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildCreateRoomMessage("support", 5)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildListRoomsMessage()
+	reply, err := bob.expect(message, LIST_ROOMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contents := reply.Contents.(ListRoomsMessage); len(contents.Rooms) != 1 || contents.Rooms[0] != "support" || len(contents.RoomInfos) != 0 {
+		t.Fatalf("Expected bob to only be sent the room names, got %+v", contents)
+	}
+
+	message, _ = alice.BuildListRoomsMessage()
+	reply, err = alice.expect(message, LIST_ROOMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rooms := reply.Contents.(ListRoomsMessage).RoomInfos; len(rooms) != 1 || rooms[0].Name != "support" {
+		t.Fatalf("Expected alice to be sent the room records, got %+v", rooms)
+	}
+}
+
+func TestRoomRoles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gochat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	database := filepath.Join(directory, "gochat.db")
+	server, address := startTestServerWithDatabase(t, database)
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	message, _ := alice.BuildCreateRoomMessage("ops", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob, carol} {
+		message, _ := client.BuildJoinRoomMessage("ops")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Members can't close the room or hand out roles
+	message, _ = bob.BuildCloseRoomMessage("ops")
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildGrantRoleMessage("ops", "bob", ROLE_MODERATOR)
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ownership only changes hands by being transferred
+	message, _ = alice.BuildGrantRoleMessage("ops", "bob", ROLE_OWNER)
+	if err := alice.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildGrantRoleMessage("ops", "dave", ROLE_MODERATOR)
+	if err := alice.expectError(message, USER_NOT_FOUND); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildGrantRoleMessage("ops", "bob", ROLE_MODERATOR)
+	if _, err := alice.expect(message, GRANT_ROLE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carol.waitForMemberEvent("bob", MEMBER_ROLE); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moderators can change the settings, but still can't hand out roles
+	message, _ = bob.BuildSetTopicMessage("ops", "Deploy freeze")
+	if _, err := bob.expect(message, SET_TOPIC); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildGrantRoleMessage("ops", "carol", ROLE_MODERATOR)
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildTransferOwnerMessage("ops", "bob")
+	if _, err := alice.expect(message, TRANSFER_OWNER); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+	server.Shutdown()
+
+	// The roles are still there after a restart
+	server, address = startTestServerWithDatabase(t, database)
+	defer server.Shutdown()
+
+	for _, username := range []string{"alice", "bob"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.authenticate(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	alice, bob = clients["alice"], clients["bob"]
+
+	message, _ = alice.BuildListMembersMessage("ops")
+	reply, err := alice.expect(message, LIST_MEMBERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles := make(map[string]string)
+	for _, member := range reply.Contents.(ListMembersMessage).Members {
+		roles[member.Username] = member.Role
+	}
+
+	if roles["alice"] != ROLE_MODERATOR || roles["bob"] != ROLE_OWNER || roles["carol"] != ROLE_MEMBER {
+		t.Fatalf("Expected bob to own ops with alice moderating, got %v", roles)
+	}
+
+	message, _ = alice.BuildRevokeRoleMessage("ops", "carol")
+	if err := alice.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildRevokeRoleMessage("ops", "alice")
+	if _, err := bob.expect(message, REVOKE_ROLE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildCloseRoomMessage("ops")
+	if err := alice.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildCloseRoomMessage("ops")
+	if _, err := bob.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listRoomNames returns the names of the rooms LIST_ROOMS shows the client
+func listRoomNames(client *testClient) ([]string, error) {
+	message, _ := client.BuildListRoomsMessage()
+	reply, err := client.expect(message, LIST_ROOMS)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, room := range reply.Contents.(ListRoomsMessage).RoomInfos {
+		names = append(names, room.Name)
+	}
+
+	return names, nil
+}
+
+func TestRoomAccessModes(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildCreateRoomWithAccessMessage("vault", 10, ACCESS_PASSWORD, "")
+	if err := alice.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildCreateRoomWithAccessMessage("vault", 10, "secret", "")
+	if err := alice.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, room := range []struct{ name, access, password string }{
+		{"lobby", ACCESS_PUBLIC, ""},
+		{"hideout", ACCESS_UNLISTED, ""},
+		{"vault", ACCESS_PASSWORD, "sesame"},
+		{"club", ACCESS_PUBLIC, ""},
+	} {
+		message, _ := alice.BuildCreateRoomWithAccessMessage(room.name, 10, room.access, room.password)
+		if _, err := alice.expect(message, RECV_MSG); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Owners can change it afterwards
+	message, _ = alice.BuildSetAccessMessage("club", ACCESS_INVITE, "")
+	if _, err := alice.expect(message, SET_ACCESS); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := listRoomNames(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(names, ",") != "club,hideout,lobby,vault" {
+		t.Fatalf("Expected alice to see every room she owns, she sees %v", names)
+	}
+
+	names, err = listRoomNames(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(names, ",") != "lobby,vault" {
+		t.Fatalf("Expected bob to only see the public and password protected rooms, he sees %v", names)
+	}
+
+	// Unlisted rooms are open to anyone who knows the name
+	message, _ = bob.BuildJoinRoomMessage("hideout")
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildJoinRoomMessage("vault")
+	if err := bob.expectError(message, WRONG_PASSWORD); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildJoinProtectedRoomMessage("vault", "open", false)
+	if err := bob.expectError(message, WRONG_PASSWORD); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildJoinProtectedRoomMessage("vault", "sesame", false)
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in an invite only room is visible until you're invited and join
+	message, _ = bob.BuildJoinRoomMessage("club")
+	if err := bob.expectError(message, NOT_INVITED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildPopulateMessage("club", time.Unix(0, 0))
+	if err := bob.expectError(message, NOT_IN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildInviteMessage("club", "bob")
+	if _, err := alice.expect(message, INVITE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.waitForText("SERVER", "alice has invited you to join club"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err = listRoomNames(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(names, ",") != "club,hideout,lobby,vault" {
+		t.Fatalf("Expected bob to see the rooms he's in or invited to, he sees %v", names)
+	}
+
+	message, _ = bob.BuildJoinRoomMessage("club")
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildPopulateMessage("club", time.Unix(0, 0))
+	if _, err := bob.expect(message, POP_MSGS); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoomSchemaUpgrade(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gochat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// A rooms table as the first release created it
+	database := filepath.Join(directory, "gochat.db")
+	db, err := sqlx.Open("sqlite3", database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.MustExec("CREATE TABLE rooms (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE, capacity INTEGER, closed BOOLEAN)")
+	db.MustExec("INSERT INTO rooms (name, capacity, closed) VALUES ('lobby', 10, 0)")
+	db.MustExec("CREATE TABLE room_members (room_id INTEGER, user_id INTEGER, joined_at INT, PRIMARY KEY (room_id, user_id))")
+	db.MustExec("CREATE TABLE messages (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, room_id INTEGER, message TEXT, epoch_timestamp INT)")
+	db.MustExec("INSERT INTO messages (user_id, room_id, message, epoch_timestamp) VALUES (1, 1, 'Anyone here?', 0)")
+	db.Close()
+
+	server, address := startTestServerWithDatabase(t, database)
+	defer server.Shutdown()
+
+	client, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := client.BuildListRoomsMessage()
+	reply, err := client.expect(message, LIST_ROOMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rooms := reply.Contents.(ListRoomsMessage).RoomInfos
+	if len(rooms) != 1 || rooms[0].Name != "lobby" || rooms[0].Owner != "" || !rooms[0].CreatedAt.IsZero() {
+		t.Fatalf("Expected the old lobby with no owner or creation time, got %+v", rooms)
+	}
+
+	// Without an owner only an administrator can change the settings or hand the room over
+	message, _ = client.BuildJoinRoomMessage("lobby")
+	if _, err := client.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = client.BuildSetTopicMessage("lobby", "Welcome")
+	if err := client.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = client.BuildTransferOwnerMessage("lobby", "alice")
+	if err := client.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SetAdmin("alice", true); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = client.BuildSetTopicMessage("lobby", "Welcome")
+	if _, err := client.expect(message, SET_TOPIC); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = client.BuildListMembersMessage("lobby")
+	reply, err = client.expect(message, LIST_MEMBERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if members := reply.Contents.(ListMembersMessage).Members; len(members) != 1 || members[0].Role != ROLE_MEMBER {
+		t.Fatalf("Expected alice to be an ordinary member of the old lobby, got %+v", members)
+	}
+
+	// Old messages come back with their IDs and no edited or deleted markers
+	message, _ = client.BuildPopulateMessage("lobby", time.Unix(0, 0))
+	reply, err = client.expect(message, POP_MSGS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := reply.Contents.(PopulateMessages).Messages
+	if len(messages) != 1 || messages[0].Id != 1 || messages[0].Text != "Anyone here?" || messages[0].Edited || messages[0].Deleted {
+		t.Fatalf("Expected the old message from alice, got %+v", messages)
+	}
+}
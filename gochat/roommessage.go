@@ -6,9 +6,26 @@ import (
 )
 
 type RoomMessage struct {
+	Id        int64  `db:"id"`
 	Username  string `db:"username"`
 	Message   string `db:"message"`
 	Timestamp int64  `db:"epoch_timestamp"`
+	Edited    bool   `db:"edited"`
+	Deleted   bool   `db:"deleted"`
+	ReplyTo   int64  `db:"reply_to"`
+}
+
+func (message RoomMessage) TextMessage(room *ServerRoom) TextMessage {
+	return TextMessage{
+		Id:       message.Id,
+		Username: message.Username,
+		Room:     room.String(),
+		Text:     message.Message,
+		Time:     time.Unix(message.Timestamp, 0),
+		Edited:   message.Edited,
+		Deleted:  message.Deleted,
+		ReplyTo:  message.ReplyTo,
+	}
 }
 
 type ServerRoomMessage struct {
@@ -8,12 +8,18 @@ import (
 )
 
 const (
-	CREATE_MESSAGE_SQL       = "INSERT INTO messages (user_id, room_id, message, epoch_timestamp) VALUES (?, ?, ?, ?)"
+	CREATE_MESSAGE_SQL       = "INSERT INTO messages (user_id, room_id, message, epoch_timestamp, reply_to) VALUES (?, ?, ?, ?, ?)"
+	EDIT_MESSAGE_SQL         = "UPDATE messages SET message=?, edited=? WHERE id=? AND room_id=?"
+	DELETE_MESSAGE_SQL       = "UPDATE messages SET message=?, deleted=? WHERE id=? AND room_id=?"
 	GET_LATEST_ROOM_MESSAGES = `
 	SELECT
+		m.id AS id,
 		u.username AS username,
 		m.message AS message,
-		m.epoch_timestamp AS epoch_timestamp
+		m.epoch_timestamp AS epoch_timestamp,
+		m.edited AS edited,
+		m.deleted AS deleted,
+		m.reply_to AS reply_to
 	FROM
 		messages AS m
 	JOIN
@@ -21,18 +27,111 @@ const (
 	WHERE
 		m.room_id=?
 		AND m.epoch_timestamp>=?
+	ORDER BY
+		m.id
 	LIMIT ?
 	`
+	GET_ROOM_MESSAGES_AFTER = `
+	SELECT
+		m.id AS id,
+		u.username AS username,
+		m.message AS message,
+		m.epoch_timestamp AS epoch_timestamp,
+		m.edited AS edited,
+		m.deleted AS deleted,
+		m.reply_to AS reply_to
+	FROM
+		messages AS m
+	JOIN
+		users AS u ON (m.user_id = u.id)
+	WHERE
+		m.room_id=?
+		AND m.id>?
+	ORDER BY
+		m.id
+	LIMIT ?
+	`
+	GET_ROOM_MESSAGE_SQL = `
+	SELECT
+		m.id AS id,
+		u.username AS username,
+		m.message AS message,
+		m.epoch_timestamp AS epoch_timestamp,
+		m.edited AS edited,
+		m.deleted AS deleted,
+		m.reply_to AS reply_to
+	FROM
+		messages AS m
+	JOIN
+		users AS u ON (m.user_id = u.id)
+	WHERE
+		m.id=?
+		AND m.room_id=?
+	`
+	GET_THREAD_SQL = `
+	WITH RECURSIVE thread (id) AS (
+		SELECT ?
+		UNION
+		SELECT r.id FROM messages AS r JOIN thread AS t ON (r.reply_to = t.id) WHERE r.room_id=?
+	)
+	SELECT
+		m.id AS id,
+		u.username AS username,
+		m.message AS message,
+		m.epoch_timestamp AS epoch_timestamp,
+		m.edited AS edited,
+		m.deleted AS deleted,
+		m.reply_to AS reply_to
+	FROM
+		messages AS m
+	JOIN
+		users AS u ON (m.user_id = u.id)
+	WHERE
+		m.id IN (SELECT id FROM thread)
+		AND m.room_id=?
+	ORDER BY
+		m.id
+	`
+	GET_UNREAD_COUNTS_SQL = `
+	SELECT
+		r.name AS room,
+		COUNT(m.id) AS unread
+	FROM
+		room_members AS rm
+	JOIN
+		rooms AS r ON (rm.room_id = r.id)
+	LEFT JOIN
+		messages AS m ON (m.room_id = rm.room_id AND m.id > rm.last_read_id AND m.epoch_timestamp >= rm.joined_at AND m.deleted=?)
+	WHERE
+		rm.user_id=?
+		AND r.closed=?
+	GROUP BY
+		r.name
+	ORDER BY
+		r.name
+	`
 	MESSAGE_SCHEMA = `
 	CREATE TABLE IF NOT EXISTS messages (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER,
 		room_id INTEGER,
 		message TEXT,
-		epoch_timestamp INT
+		epoch_timestamp INT,
+		edited BOOLEAN DEFAULT false,
+		deleted BOOLEAN DEFAULT false,
+		reply_to INTEGER DEFAULT 0
 	)`
 )
 
+// MESSAGE_COLUMNS are the columns added to the messages table since it was first released, with their definitions
+var MESSAGE_COLUMNS = [][2]string{
+	{"edited", "BOOLEAN DEFAULT false"},
+	{"deleted", "BOOLEAN DEFAULT false"},
+	{"reply_to", "INTEGER DEFAULT 0"},
+}
+
+var ErrMessageDoesNotExist = NewChatError(MESSAGE_NOT_FOUND, "Message doesn't exist")
+
 type RoomMessageManager struct {
 	storageManager *StorageManager
 	roomManager    *RoomManager
@@ -48,6 +147,13 @@ func NewRoomMessageManager(storageManager *StorageManager, roomManager *RoomMana
 		return &RoomMessageManager{}, errors.New("Failed to generate the TextMessage schema.")
 	}
 
+	for _, column := range MESSAGE_COLUMNS {
+		if err := storageManager.AddColumnIfMissing("messages", column[0], column[1]); err != nil {
+			logger.Error(err)
+			return &RoomMessageManager{}, errors.New("Failed to add the " + column[0] + " column to the TextMessage schema.")
+		}
+	}
+
 	manager := RoomMessageManager{
 		storageManager: storageManager,
 		roomManager:    roomManager,
@@ -58,48 +164,140 @@ func NewRoomMessageManager(storageManager *StorageManager, roomManager *RoomMana
 	return &manager, nil
 }
 
-func (manager *RoomMessageManager) PersistRoomMessage(user *ServerUser, room *ServerRoom, message string) error {
+// PersistRoomMessage stores the message, returning the ID it was given
+// replyTo is the ID of the message it's replying to, 0 if it isn't a reply
+func (manager *RoomMessageManager) PersistRoomMessage(user *ServerUser, room *ServerRoom, message string, sent time.Time, replyTo int64) (int64, error) {
 	sql := manager.storageManager.db.Rebind(CREATE_MESSAGE_SQL)
-	err := manager.storageManager.ExecOneRow(manager.storageManager.db.Exec(sql, user.User.Id, room.Room.Id, message, time.Now().Unix()))
+	result, err := manager.storageManager.db.Exec(sql, user.User.Id, room.Room.Id, message, sent.Unix(), replyTo)
+	if err := manager.storageManager.ExecOneRow(result, err); err != nil {
+		manager.logger.Error(err)
+		return 0, errors.New("Failed to run CREATE_MESSAGE_SQL")
+	}
+
+	id, err := result.LastInsertId()
 	if err != nil {
 		manager.logger.Error(err)
-		return errors.New("Failed to run CREATE_MESSAGE_SQL")
+		return 0, errors.New("Failed to get the ID of the new message")
 	}
 
-	return nil
+	return id, nil
 }
 
-func (manager *RoomMessageManager) GetRoomMessagesSince(room *ServerRoom, timeSince time.Time, limit int) ([]TextMessage, error) {
-	var messages []TextMessage
-	sql := manager.storageManager.db.Rebind(GET_LATEST_ROOM_MESSAGES)
-	rows, err := manager.storageManager.db.Queryx(sql, room.Room.Id, timeSince.Unix(), limit)
-	if err != nil {
+// GetRoomMessagesSince returns up to limit of the room's messages sent from timeSince on, oldest first
+// It also returns the ID of the last of them (0 if there were none) so it can be marked as read
+func (manager *RoomMessageManager) GetRoomMessagesSince(room *ServerRoom, timeSince time.Time, limit int) ([]TextMessage, int64, error) {
+	return manager.getRoomMessages(room, GET_LATEST_ROOM_MESSAGES, timeSince.Unix(), limit)
+}
+
+// GetRoomMessagesAfter returns up to limit of the room's messages sent after the given message, oldest first
+func (manager *RoomMessageManager) GetRoomMessagesAfter(room *ServerRoom, messageId int64, limit int) ([]TextMessage, int64, error) {
+	return manager.getRoomMessages(room, GET_ROOM_MESSAGES_AFTER, messageId, limit)
+}
+
+func (manager *RoomMessageManager) getRoomMessages(room *ServerRoom, query string, after int64, limit int) ([]TextMessage, int64, error) {
+	var dbRoomMessages []RoomMessage
+	var lastId int64
+
+	sql := manager.storageManager.db.Rebind(query)
+	if err := manager.storageManager.db.Select(&dbRoomMessages, sql, room.Room.Id, after, limit); err != nil {
 		manager.logger.Error(err)
-		return messages, errors.New("Failed to run GET_LATEST_ROOM_MESSAGES")
+		return nil, 0, errors.New("Failed to load the room's messages")
 	}
 
-	for rows.Next() {
-		var dbRoomMessage RoomMessage
-		err = rows.StructScan(&dbRoomMessage)
-		if err != nil {
-			manager.logger.Error(err)
-			return messages, errors.New("Failed to parse GET_LATEST_ROOM_MESSAGES result into struct")
-		}
+	messages := []TextMessage{}
+	for _, dbRoomMessage := range dbRoomMessages {
+		messages = append(messages, dbRoomMessage.TextMessage(room))
+		lastId = dbRoomMessage.Id
+	}
 
-		user, err := manager.userManager.GetUser(dbRoomMessage.Username)
-		if err != nil {
-			manager.logger.Error(err)
-			return messages, errors.New("Failed to load the user from dbRoomMessage")
-		}
+	return messages, lastId, nil
+}
 
-		roomMessage := TextMessage{
-			Username: user.User.Username,
-			Room:     room.String(),
-			Text:     dbRoomMessage.Message,
-			Time:     time.Unix(dbRoomMessage.Timestamp, 0),
+// GetRoomMessage returns the message with the given ID, as long as it was sent to the room
+func (manager *RoomMessageManager) GetRoomMessage(room *ServerRoom, messageId int64) (TextMessage, error) {
+	var dbRoomMessages []RoomMessage
+
+	sql := manager.storageManager.db.Rebind(GET_ROOM_MESSAGE_SQL)
+	if err := manager.storageManager.db.Select(&dbRoomMessages, sql, messageId, room.Room.Id); err != nil {
+		manager.logger.Error(err)
+		return TextMessage{}, errors.New("Failed to run GET_ROOM_MESSAGE_SQL")
+	}
+
+	if len(dbRoomMessages) == 0 {
+		return TextMessage{}, ErrMessageDoesNotExist
+	}
+
+	return dbRoomMessages[0].TextMessage(room), nil
+}
+
+// GetThread returns the whole thread the message is part of, from the message that started it through every reply
+// to it (and replies to those) oldest first
+func (manager *RoomMessageManager) GetThread(room *ServerRoom, messageId int64) ([]TextMessage, error) {
+	root, err := manager.GetRoomMessage(room, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replies can only be made to messages that already exist, so walking up always ends at the top
+	for root.ReplyTo != 0 {
+		parent, err := manager.GetRoomMessage(room, root.ReplyTo)
+		if err == ErrMessageDoesNotExist {
+			break
+		} else if err != nil {
+			return nil, err
 		}
-		messages = append(messages, roomMessage)
+
+		root = parent
+	}
+
+	var dbRoomMessages []RoomMessage
+
+	sql := manager.storageManager.db.Rebind(GET_THREAD_SQL)
+	if err := manager.storageManager.db.Select(&dbRoomMessages, sql, root.Id, room.Room.Id, room.Room.Id); err != nil {
+		manager.logger.Error(err)
+		return nil, errors.New("Failed to run GET_THREAD_SQL")
+	}
+
+	messages := []TextMessage{}
+	for _, dbRoomMessage := range dbRoomMessages {
+		messages = append(messages, dbRoomMessage.TextMessage(room))
 	}
 
 	return messages, nil
 }
+
+// EditRoomMessage replaces the text of the message, marking it as edited
+func (manager *RoomMessageManager) EditRoomMessage(room *ServerRoom, messageId int64, message string) error {
+	sql := manager.storageManager.db.Rebind(EDIT_MESSAGE_SQL)
+	if err := manager.storageManager.ExecOneRow(manager.storageManager.db.Exec(sql, message, true, messageId, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run EDIT_MESSAGE_SQL")
+	}
+
+	return nil
+}
+
+// DeleteRoomMessage blanks out the message, it stays in the history marked as deleted
+func (manager *RoomMessageManager) DeleteRoomMessage(room *ServerRoom, messageId int64) error {
+	sql := manager.storageManager.db.Rebind(DELETE_MESSAGE_SQL)
+	if err := manager.storageManager.ExecOneRow(manager.storageManager.db.Exec(sql, "", true, messageId, room.Room.Id)); err != nil {
+		manager.logger.Error(err)
+		return errors.New("Failed to run DELETE_MESSAGE_SQL")
+	}
+
+	return nil
+}
+
+// GetUnreadCounts returns how many messages the user hasn't read in each of their open rooms
+// Messages from before they joined a room, and ones that have since been deleted, don't count
+func (manager *RoomMessageManager) GetUnreadCounts(user *ServerUser) ([]UnreadCount, error) {
+	counts := []UnreadCount{}
+
+	sql := manager.storageManager.db.Rebind(GET_UNREAD_COUNTS_SQL)
+	if err := manager.storageManager.db.Select(&counts, sql, false, user.User.Id, false); err != nil {
+		manager.logger.Error(err)
+		return nil, errors.New("Failed to run GET_UNREAD_COUNTS_SQL")
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,412 @@
+package gochat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// unreadIn asks the server how many unread messages the client has in the room
+func unreadIn(client *testClient, room string) (int, error) {
+	message, _ := client.BuildUnreadMessage()
+	reply, err := client.expect(message, UNREAD)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, count := range reply.Contents.(UnreadMessage).Rooms {
+		if count.Room == room {
+			return count.Unread, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Expected an unread count for %s", room)
+}
+
+func TestUnreadAndLastRead(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildCreateRoomMessage("lounge", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		message, _ := client.BuildJoinRoomMessage("lounge")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	say := func(text string) {
+		message, _ := alice.BuildSendMessageMessage(text, "lounge")
+		if err := SendRemoteCommand(alice.codec, message); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := alice.waitForText("alice", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	say("one")
+
+	if err := bob.waitForText("alice", "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Being sent a message isn't the same as reading it
+	if unread, err := unreadIn(bob, "lounge"); err != nil || unread != 1 {
+		t.Fatalf("Expected bob to have 1 unread message but got %d (%v)", unread, err)
+	}
+
+	message, _ = bob.BuildPopulateSinceLastReadMessage("lounge", time.Unix(0, 0))
+	reply, err := bob.expect(message, POP_MSGS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := reply.Contents.(PopulateMessages).Messages; len(messages) != 1 || messages[0].Text != "one" {
+		t.Fatalf("Expected bob to be sent the message he hasn't read but got %v", messages)
+	}
+
+	bob.Close()
+
+	if err := alice.waitForMemberEvent("bob", MEMBER_OFFLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	say("two")
+	say("three")
+
+	bob, err = connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := bob.authenticate("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if unread, err := unreadIn(bob, "lounge"); err != nil || unread != 2 {
+		t.Fatalf("Expected bob to have 2 unread messages but got %d (%v)", unread, err)
+	}
+
+	if unread, err := unreadIn(alice, "lounge"); err != nil || unread != 0 {
+		t.Fatalf("Expected alice to have read everything but got %d unread (%v)", unread, err)
+	}
+
+	// Backfill picks up where he left off rather than going back to TimeSince
+	message, _ = bob.BuildPopulateSinceLastReadMessage("lounge", time.Unix(0, 0))
+	reply, err = bob.expect(message, POP_MSGS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := reply.Contents.(PopulateMessages).Messages
+	if len(messages) != 2 || messages[0].Text != "two" || messages[1].Text != "three" {
+		t.Fatalf("Expected bob to be sent the 2 messages he missed but got %v", messages)
+	}
+
+	if unread, err := unreadIn(bob, "lounge"); err != nil || unread != 0 {
+		t.Fatalf("Expected the backfill to mark bob's messages as read but got %d unread (%v)", unread, err)
+	}
+
+	reply, err = bob.expect(message, POP_MSGS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := reply.Contents.(PopulateMessages).Messages; len(messages) != 0 {
+		t.Fatalf("Expected nothing new since the last backfill but got %v", messages)
+	}
+}
+
+// waitForRoomMessage waits for a RECV_MSG from username with the given text, returning it so its ID can be used
+func (client *testClient) waitForRoomMessage(username string, text string) (TextMessage, error) {
+	timeout := time.After(REPLY_TIMEOUT)
+
+	for {
+		select {
+		case message := <-client.pushes:
+			if contents, ok := message.Contents.(RecvTextMessage); ok {
+				if contents.Message.Username == username && contents.Message.Text == text {
+					return contents.Message, nil
+				}
+			}
+		case <-timeout:
+			return TextMessage{}, fmt.Errorf("Timed out waiting for %s to receive '%s'", username, text)
+		}
+	}
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	// Dave's client predates edits
+	dave, err := connectTestClientWithHello(address, HelloMessage{Version: PROTOCOL_VERSION, Features: featuresWithout(FEATURE_EDITS)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dave.Close()
+
+	if err := dave.login("dave", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	message, _ := alice.BuildCreateRoomMessage("lounge", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob, carol, dave} {
+		message, _ := client.BuildJoinRoomMessage("lounge")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message, _ = bob.BuildSendMessageMessage("helo", "lounge")
+	if err := SendRemoteCommand(bob.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := carol.waitForRoomMessage("bob", "helo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent.Id == 0 {
+		t.Fatal("Expected the message to be sent out with its ID")
+	}
+
+	// Ordinary members can only change their own messages
+	message, _ = carol.BuildEditMessageMessage("lounge", sent.Id, "goodbye")
+	if err := carol.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildEditMessageMessage("lounge", sent.Id, "")
+	if err := bob.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildEditMessageMessage("lounge", sent.Id+100, "hello")
+	if err := bob.expectError(message, MESSAGE_NOT_FOUND); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildEditMessageMessage("lounge", sent.Id, "hello")
+	if _, err := bob.expect(message, EDIT_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	edit, err := carol.waitForCommand(EDIT_MSG)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edited := edit.Contents.(EditTextMessage).Message; edited.Id != sent.Id || edited.Text != "hello" || !edited.Edited {
+		t.Fatalf("Expected carol to be sent the edited message but got %+v", edited)
+	}
+
+	if err := dave.waitForText("SERVER", fmt.Sprintf("bob edited message #%d: hello", sent.Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner can delete anyone's
+	message, _ = alice.BuildDeleteMessageMessage("lounge", sent.Id)
+	if _, err := alice.expect(message, DELETE_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := carol.waitForCommand(DELETE_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dave.waitForText("SERVER", fmt.Sprintf("Message #%d from bob was deleted", sent.Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildEditMessageMessage("lounge", sent.Id, "hello again")
+	if err := bob.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildPopulateMessage("lounge", time.Unix(0, 0))
+	reply, err := carol.expect(message, POP_MSGS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := reply.Contents.(PopulateMessages).Messages
+	if len(history) != 1 || history[0].Id != sent.Id || !history[0].Deleted || history[0].Text != "" {
+		t.Fatalf("Expected the history to keep the deleted message without its text but got %+v", history)
+	}
+
+	message, _ = carol.BuildSendMessageMessage("mine", "lounge")
+	if err := SendRemoteCommand(carol.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	mine, err := carol.waitForRoomMessage("carol", "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Muted members can't change their messages any more than they can send new ones
+	message, _ = alice.BuildMuteMessage("lounge", "carol", "Quiet", 0)
+	if _, err := alice.expect(message, MUTE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildEditMessageMessage("lounge", mine.Id, "changed")
+	if err := carol.expectError(message, MUTED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildDeleteMessageMessage("lounge", mine.Id)
+	if err := carol.expectError(message, MUTED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildUnmuteMessage("lounge", "carol")
+	if _, err := alice.expect(message, UNMUTE); err != nil {
+		t.Fatal(err)
+	}
+
+	// Having left the room carol can still look in from outside, but not change anything in it
+	message, _ = carol.BuildLeaveRoomMessage("lounge")
+	if _, err := carol.expect(message, LEAVE_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildEditMessageMessage("lounge", mine.Id, "changed")
+	if err := carol.expectError(message, NOT_IN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildDeleteMessageMessage("lounge", mine.Id)
+	if err := carol.expectError(message, NOT_IN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThreadedReplies(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	alice, bob := clients["alice"], clients["bob"]
+
+	message, _ := alice.BuildCreateRoomMessage("lounge", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		message, _ := client.BuildJoinRoomMessage("lounge")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// say sends the message and waits for it to come back so we know its ID
+	say := func(client *testClient, text string, replyTo int64) TextMessage {
+		message, _ := client.BuildReplyMessage(text, "lounge", replyTo)
+		if err := SendRemoteCommand(client.codec, message); err != nil {
+			t.Fatal(err)
+		}
+
+		sent, err := client.waitForRoomMessage(client.username, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sent.ReplyTo != replyTo {
+			t.Fatalf("Expected '%s' to be a reply to #%d but got #%d", text, replyTo, sent.ReplyTo)
+		}
+
+		return sent
+	}
+
+	lunch := say(alice, "Lunch?", 0)
+	yes := say(bob, "Yes", lunch.Id)
+	say(alice, "Unrelated", 0)
+	when := say(alice, "Noon?", yes.Id)
+	say(bob, "Sure", lunch.Id)
+
+	message, _ = bob.BuildReplyMessage("Hello?", "lounge", when.Id+100)
+	if err := bob.expectError(message, MESSAGE_NOT_FOUND); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any message in the thread brings back all of it
+	message, _ = bob.BuildGetThreadMessage("lounge", when.Id)
+	reply, err := bob.expect(message, GET_THREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	for _, textMessage := range reply.Contents.(GetThreadMessage).Messages {
+		texts = append(texts, textMessage.Text)
+	}
+
+	if fmt.Sprint(texts) != "[Lunch? Yes Noon? Sure]" {
+		t.Fatalf("Expected the thread to be every reply to Lunch? in order but got %v", texts)
+	}
+}
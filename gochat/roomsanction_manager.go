@@ -0,0 +1,150 @@
+package gochat
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	SANCTION_KICK = "kick"
+	SANCTION_BAN  = "ban"
+	SANCTION_MUTE = "mute"
+)
+
+const (
+	CREATE_SANCTION_SQL = "INSERT INTO room_sanctions (room_id, user_id, kind, reason, actor_id, created_at, expires_at, lifted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	LIFT_SANCTIONS_SQL  = "UPDATE room_sanctions SET lifted=? WHERE room_id=? AND user_id=? AND kind=? AND lifted=? AND (expires_at=0 OR expires_at>?)"
+	GET_SANCTION_SQL    = `
+	SELECT
+		s.kind AS kind,
+		s.reason AS reason,
+		COALESCE(u.username, '') AS actor,
+		s.created_at AS created_at,
+		s.expires_at AS expires_at
+	FROM
+		room_sanctions AS s
+	LEFT JOIN
+		users AS u ON (s.actor_id = u.id)
+	WHERE
+		s.room_id=?
+		AND s.user_id=?
+		AND s.kind=?
+		AND s.lifted=?
+		AND (s.expires_at=0 OR s.expires_at>?)
+	ORDER BY
+		s.expires_at=0 DESC,
+		s.expires_at DESC
+	LIMIT 1
+	`
+	ROOM_SANCTIONS_SCHEMA = `
+	CREATE TABLE IF NOT EXISTS room_sanctions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER,
+		user_id INTEGER,
+		kind TEXT,
+		reason TEXT,
+		actor_id INTEGER,
+		created_at INT,
+		expires_at INT,
+		lifted BOOLEAN
+	)`
+)
+
+// Sanction is a kick, ban or mute of a user in a room, an ExpiresAt of 0 means it never expires
+// Kicks are only kept for the record, they expire the moment they're made
+type Sanction struct {
+	Kind      string `db:"kind"`
+	Reason    string `db:"reason"`
+	Actor     string `db:"actor"`
+	CreatedAt int64  `db:"created_at"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+// Expires returns when the sanction runs out, the zero time if it never does
+func (sanction Sanction) Expires() time.Time {
+	if sanction.ExpiresAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sanction.ExpiresAt, 0)
+}
+
+type RoomSanctionManager struct {
+	storageManager *StorageManager
+	logger         *log.Entry
+}
+
+func NewRoomSanctionManager(storageManager *StorageManager, logger *log.Entry) (*RoomSanctionManager, error) {
+	// Create the room_sanctions table if it doesn't already exist
+	_, err := storageManager.db.Exec(ROOM_SANCTIONS_SCHEMA)
+	if err != nil {
+		logger.Error(err)
+		return &RoomSanctionManager{}, errors.New("Failed to generate the room sanctions schema.")
+	}
+
+	manager := RoomSanctionManager{
+		storageManager: storageManager,
+		logger:         logger,
+	}
+
+	return &manager, nil
+}
+
+// AddSanction records the actor sanctioning the user in the room, a duration of 0 makes bans and mutes permanent
+func (manager *RoomSanctionManager) AddSanction(room *ServerRoom, user *ServerUser, actor *ServerUser, kind string, reason string, duration time.Duration) (Sanction, error) {
+	now := time.Now()
+
+	sanction := Sanction{Kind: kind, Reason: reason, Actor: actor.User.Username, CreatedAt: now.Unix()}
+
+	if kind == SANCTION_KICK {
+		sanction.ExpiresAt = sanction.CreatedAt
+	} else if duration > 0 {
+		sanction.ExpiresAt = now.Add(duration).Unix()
+	}
+
+	sql := manager.storageManager.db.Rebind(CREATE_SANCTION_SQL)
+	err := manager.storageManager.ExecOneRow(manager.storageManager.db.Exec(sql,
+		room.Room.Id, user.User.Id, kind, reason, actor.User.Id, sanction.CreatedAt, sanction.ExpiresAt, false))
+	if err != nil {
+		manager.logger.Error(err)
+		return Sanction{}, errors.New("Failed to run CREATE_SANCTION_SQL")
+	}
+
+	return sanction, nil
+}
+
+// GetActiveSanction returns the user's longest lasting sanction of that kind in the room, if they have one
+func (manager *RoomSanctionManager) GetActiveSanction(room *ServerRoom, user *ServerUser, kind string) (Sanction, bool, error) {
+	var sanctions []Sanction
+
+	sql := manager.storageManager.db.Rebind(GET_SANCTION_SQL)
+	if err := manager.storageManager.db.Select(&sanctions, sql, room.Room.Id, user.User.Id, kind, false, time.Now().Unix()); err != nil {
+		manager.logger.Error(err)
+		return Sanction{}, false, errors.New("Failed to run GET_SANCTION_SQL")
+	}
+
+	if len(sanctions) == 0 {
+		return Sanction{}, false, nil
+	}
+
+	return sanctions[0], true, nil
+}
+
+// LiftSanctions ends any of the user's sanctions of that kind in the room early, returning false if they didn't have any
+func (manager *RoomSanctionManager) LiftSanctions(room *ServerRoom, user *ServerUser, kind string) (bool, error) {
+	sql := manager.storageManager.db.Rebind(LIFT_SANCTIONS_SQL)
+	result, err := manager.storageManager.db.Exec(sql, true, room.Room.Id, user.User.Id, kind, false, time.Now().Unix())
+	if err != nil {
+		manager.logger.Error(err)
+		return false, errors.New("Failed to run LIFT_SANCTIONS_SQL")
+	}
+
+	lifted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return lifted > 0, nil
+}
@@ -0,0 +1,184 @@
+package gochat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKickBanAndMute(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	clients := make(map[string]*testClient)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		client, err := connectTestClient(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login(username, "password"); err != nil {
+			t.Fatal(err)
+		}
+
+		clients[username] = client
+	}
+
+	alice, bob, carol, dave := clients["alice"], clients["bob"], clients["carol"], clients["dave"]
+
+	message, _ := alice.BuildCreateRoomMessage("lounge", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, bob, carol} {
+		message, _ := client.BuildJoinRoomMessage("lounge")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message, _ = alice.BuildGrantRoleMessage("lounge", "carol", ROLE_MODERATOR)
+	if _, err := alice.expect(message, GRANT_ROLE); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members can't kick anyone, and moderators can't kick the owner
+	message, _ = bob.BuildKickMessage("lounge", "carol", "")
+	if err := bob.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildKickMessage("lounge", "alice", "")
+	if err := carol.expectError(message, PERMISSION_DENIED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildKickMessage("lounge", "bob", "Being rude")
+	if _, err := carol.expect(message, KICK); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.waitForCommand(LEAVE_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	// A kick doesn't stop them coming back
+	message, _ = bob.BuildJoinRoomMessage("lounge")
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	// A negative duration is a mistake, not another way of saying permanent
+	message, _ = carol.BuildMuteMessage("lounge", "bob", "Still rude", -time.Second)
+	if err := carol.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildBanMessage("lounge", "bob", "Still rude", -time.Second)
+	if err := carol.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildSendMessageMessage("still here", "lounge")
+	if err := SendRemoteCommand(bob.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.waitForText("bob", "still here"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildMuteMessage("lounge", "bob", "Still rude", 0)
+	if _, err := carol.expect(message, MUTE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildSendMessageMessage("hello?", "lounge")
+	if err := bob.expectError(message, MUTED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildUnmuteMessage("lounge", "bob")
+	if _, err := carol.expect(message, UNMUTE); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = carol.BuildUnmuteMessage("lounge", "bob")
+	if err := carol.expectError(message, BAD_REQUEST); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildSendMessageMessage("sorry", "lounge")
+	if err := SendRemoteCommand(bob.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := carol.waitForText("bob", "sorry"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bans keep them out until they expire
+	message, _ = carol.BuildBanMessage("lounge", "bob", "Not sorry enough", 2*time.Second)
+	reply, err := carol.expect(message, BAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Contents.(BanMessage).Expires.IsZero() {
+		t.Fatal("Expected a temporary ban to say when it expires")
+	}
+
+	if _, err := bob.waitForCommand(LEAVE_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildJoinRoomMessage("lounge")
+	if err := bob.expectError(message, BANNED); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor can he talk in the room, or look in on it, from outside
+	message, _ = bob.BuildSendMessageMessage("let me back in", "lounge")
+	if err := bob.expectError(message, NOT_IN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildPopulateMessage("lounge", time.Unix(0, 0))
+	if err := bob.expectError(message, BANNED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = bob.BuildListMembersMessage("lounge")
+	if err := bob.expectError(message, BANNED); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	message, _ = bob.BuildJoinRoomMessage("lounge")
+	if _, err := bob.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users can be banned before they ever join, until someone lifts it
+	message, _ = alice.BuildBanMessage("lounge", "dave", "", 0)
+	if _, err := alice.expect(message, BAN); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = dave.BuildJoinRoomMessage("lounge")
+	if err := dave.expectError(message, BANNED); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = alice.BuildUnbanMessage("lounge", "dave")
+	if _, err := alice.expect(message, UNBAN); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ = dave.BuildJoinRoomMessage("lounge")
+	if _, err := dave.expect(message, JOIN_ROOM); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,16 @@
 package gochat
 
 import (
-	"encoding/gob"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,14 +18,67 @@ import (
 )
 
 type ChatServer struct {
-	userManager    *UserManager
-	roomManager    *RoomManager
-	messageManager *RoomMessageManager
-	logger         *log.Entry
+	storageManager       *StorageManager
+	userManager          *UserManager
+	roomManager          *RoomManager
+	messageManager       *RoomMessageManager
+	sanctionManager      *RoomSanctionManager
+	directMessageManager *DirectMessageManager
+	logger               *log.Entry
+	tlsConfig            *tls.Config
+	connection           ConnectionConfig
+	outbound             OutboundConfig
+	shutdown             ShutdownConfig
+	lock                 sync.Mutex
+	shuttingDown         bool
+	listeners            []io.Closer
+	sessions             map[*Session]bool
+	handlers             sync.WaitGroup
 }
 
 type ServerConfig struct {
-	Database DatabaseConfig `yaml:"database"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Listeners  []ListenerConfig `yaml:"listeners"`
+	WebSocket  WebSocketConfig  `yaml:"websocket"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Connection ConnectionConfig `yaml:"connection"`
+	Outbound   OutboundConfig   `yaml:"outbound"`
+	Shutdown   ShutdownConfig   `yaml:"shutdown"`
+}
+
+// ShutdownConfig controls how Shutdown winds the server down
+// Timeout is the total time allowed, ReconnectHint is passed on to clients (Eg. the address of another server)
+type ShutdownConfig struct {
+	Timeout       time.Duration `yaml:"timeout"`
+	ReconnectHint string        `yaml:"reconnect_hint"`
+}
+
+// ConnectionConfig controls how quickly the server gives up on clients
+// The server PINGs every PingInterval, a client that sends nothing (not even a PONG) for ReadTimeout is dropped
+// IdleTimeout (disabled when 0) drops clients that send nothing but PINGs and PONGs for that long, heartbeat or not
+type ConnectionConfig struct {
+	PingInterval time.Duration `yaml:"ping_interval"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+func (config ConnectionConfig) withDefaults() ConnectionConfig {
+	if config.PingInterval <= 0 {
+		config.PingInterval = DEFAULT_PING_INTERVAL
+	}
+
+	if config.ReadTimeout <= 0 {
+		// Allow a couple of PINGs to go unanswered before giving up
+		config.ReadTimeout = config.PingInterval * 3
+	}
+
+	return config
+}
+
+// ListenerConfig describes an additional address to accept connections on and the codec spoken there
+type ListenerConfig struct {
+	Address string `yaml:"address"`
+	Codec   string `yaml:"codec"`
 }
 
 type DatabaseConfig struct {
@@ -32,274 +90,1680 @@ type DatabaseConfig struct {
 	Password string `yaml:"password"`
 }
 
-func NewChatServer(logger *log.Entry, config ServerConfig) (*ChatServer, error) {
-	storageManager, err := NewStorageManager(config.Database, logger)
-	if err != nil {
-		return &ChatServer{}, err
-	}
+func NewChatServer(logger *log.Entry, config ServerConfig) (*ChatServer, error) {
+	storageManager, err := NewStorageManager(config.Database, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	userManager, err := NewUserManager(storageManager, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	roomManager, err := NewRoomManager(storageManager, userManager, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	messageManager, err := NewRoomMessageManager(storageManager, roomManager, userManager, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	sanctionManager, err := NewRoomSanctionManager(storageManager, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	directMessageManager, err := NewDirectMessageManager(storageManager, logger)
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	outbound, err := config.Outbound.withDefaults()
+	if err != nil {
+		return &ChatServer{}, err
+	}
+
+	if config.Shutdown.Timeout <= 0 {
+		config.Shutdown.Timeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	chat_server := ChatServer{
+		storageManager:       storageManager,
+		userManager:          userManager,
+		roomManager:          roomManager,
+		messageManager:       messageManager,
+		sanctionManager:      sanctionManager,
+		directMessageManager: directMessageManager,
+		logger:               logger,
+		connection:           config.Connection.withDefaults(),
+		outbound:             outbound,
+		shutdown:             config.Shutdown,
+		sessions:             make(map[*Session]bool),
+	}
+
+	if config.TLS.Enabled() {
+		chat_server.tlsConfig, err = LoadServerTLSConfig(config.TLS)
+		if err != nil {
+			return &ChatServer{}, err
+		}
+	}
+
+	return &chat_server, nil
+}
+
+func (server *ChatServer) Listen(connection_string string, codec string) error {
+	if !ValidCodec(codec) {
+		return errors.New("Unable to listen on " + connection_string + ", unknown codec '" + codec + "'")
+	}
+
+	// Bind to the IP/Port and listen for new incoming connections
+	var socket net.Listener
+	var err error
+
+	if server.tlsConfig != nil {
+		socket, err = tls.Listen("tcp", connection_string, server.tlsConfig)
+	} else {
+		socket, err = net.Listen("tcp", connection_string)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	server.logger.Info("Listening on " + connection_string + " (" + codec + ", TLS: " + strconv.FormatBool(server.tlsConfig != nil) + ")")
+
+	return server.Serve(socket, codec)
+}
+
+// Serve accepts connections on an already bound socket until Shutdown is called
+func (server *ChatServer) Serve(socket net.Listener, codec string) error {
+	if !ValidCodec(codec) {
+		return errors.New("Unable to serve on " + socket.Addr().String() + ", unknown codec '" + codec + "'")
+	}
+
+	if !server.trackListener(socket) {
+		socket.Close()
+		return nil
+	}
+
+	for {
+		connection, err := socket.Accept()
+		if err != nil {
+			if server.isShuttingDown() {
+				// Shutdown closed the socket on us
+				return nil
+			}
+
+			return err
+		}
+
+		server.logger.Info("Accepted incoming connection")
+		codec, _ := NewCodec(codec, connection)
+		go server.HandleIncomingConnection(connection, codec)
+	}
+}
+
+// Connection is what the server needs from a client connection beyond its Codec
+// Both net.Conn and *websocket.Conn satisfy it
+type Connection interface {
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+func (server *ChatServer) HandleIncomingConnection(connection Connection, codec Codec) {
+	// The client must introduce itself before we interpret anything else it sends
+	connection.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	hello, err := server.handshake(codec)
+	if err != nil {
+		server.logger.Info("Rejected connection: " + err.Error())
+		connection.Close()
+		return
+	}
+
+	// Everything we send from here on is queued, so nothing (Eg. a room broadcast) ever waits on this client
+	outbound := NewOutboundQueue(codec, server.outbound, func() {
+		server.logger.Info("Closing connection, it isn't keeping up with its outbound messages")
+		connection.Close()
+	})
+	session := NewSession(connection, outbound, hello.Version, hello.Features)
+
+	// However we stop talking to this client, make sure its user stops sending it anything
+	defer server.dropSession(session)
+
+	if !server.trackSession(session) {
+		// We started shutting down while the client was saying HELLO
+		return
+	}
+
+	// Clients that can't answer PINGs are only dropped for being idle or when their connection errors
+	heartbeat := hasFeature(hello.Features, FEATURE_HEARTBEAT)
+
+	// PING the client regularly so we notice if it silently goes away
+	stopPinging := make(chan bool)
+	defer close(stopPinging)
+	if heartbeat {
+		go server.pingConnection(session, stopPinging)
+	}
+
+	lastActivity := time.Now()
+
+	for {
+		// Anything from the client (including a PONG) pushes the read deadline back, only other commands put off the idle one
+		var deadline time.Time
+		if heartbeat {
+			deadline = time.Now().Add(server.connection.ReadTimeout)
+		}
+
+		if idleTimeout := server.connection.IdleTimeout; idleTimeout > 0 {
+			if idleDeadline := lastActivity.Add(idleTimeout); deadline.IsZero() || idleDeadline.Before(deadline) {
+				deadline = idleDeadline
+			}
+		}
+
+		connection.SetReadDeadline(deadline)
+
+		message := Message{}
+		if err := codec.Decode(&message); err != nil {
+			if server.isShuttingDown() {
+				server.logger.Debug("Connection closed for shutdown")
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if idleTimeout := server.connection.IdleTimeout; idleTimeout > 0 && time.Since(lastActivity) >= idleTimeout {
+					server.logger.Info("Dropping connection, idle for " + idleTimeout.String())
+				} else {
+					server.logger.Info("Dropping connection, nothing received for " + server.connection.ReadTimeout.String())
+				}
+			} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+				server.logger.Info("Client disconnected")
+			} else {
+				// We can't trust anything else on a stream we failed to decode
+				server.logger.Info("Dropping connection, unable to decode message: " + err.Error())
+			}
+
+			return
+		}
+
+		// Heartbeats keep the connection open but don't count as the client doing anything
+		if message.Command != PING && message.Command != PONG {
+			lastActivity = time.Now()
+		}
+
+		// Once we're shutting down nothing new gets started, Shutdown will disconnect the client shortly
+		if !server.beginHandling() {
+			continue
+		}
+
+		server.logger.Debug("Handling incoming " + message.Command + " message.")
+		reply, err := server.HandleMessage(message, session)
+		if err == nil && reply.Command != "" {
+			// Only send a reply if the command is not empty
+			reply = server.fitReply(session, message, reply)
+			server.logger.Debug("Sending " + reply.Command + " response.")
+			session.Encode(reply)
+		}
+
+		server.handlers.Done()
+
+		if err != nil {
+			server.logger.Error(err)
+			return
+		}
+	}
+}
+
+// fitReply only copies the request's RequestId into the reply for sessions that negotiated FEATURE_REQUEST_IDS
+// Sessions that didn't negotiate FEATURE_ERRORS are sent ERRORs as text from SERVER
+func (server *ChatServer) fitReply(session *Session, request Message, reply Message) Message {
+	if reply.Command == ERROR && !session.HasFeature(FEATURE_ERRORS) {
+		text := reply.Contents.(ErrorMessage).Message
+		reply = BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: text}})
+	}
+
+	if session.HasFeature(FEATURE_REQUEST_IDS) {
+		reply.RequestId = request.RequestId
+	}
+
+	return reply
+}
+
+// errorReply builds the ERROR reply to a failed command, logging errors that the client is only told were internal
+func (server *ChatServer) errorReply(command COMMAND, err error) Message {
+	if _, ok := err.(*ChatError); !ok {
+		server.logger.Error(fmt.Sprintf("Failed to handle %s: %v", command, err))
+	}
+
+	return BuildErrorMessage(command, err)
+}
+
+func (server *ChatServer) isShuttingDown() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.shuttingDown
+}
+
+func (server *ChatServer) trackListener(listener io.Closer) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.shuttingDown {
+		return false
+	}
+
+	server.listeners = append(server.listeners, listener)
+	return true
+}
+
+func (server *ChatServer) trackSession(session *Session) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.shuttingDown {
+		return false
+	}
+
+	server.sessions[session] = true
+	return true
+}
+
+func (server *ChatServer) beginHandling() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.shuttingDown {
+		return false
+	}
+
+	server.handlers.Add(1)
+	return true
+}
+
+// Shutdown stops accepting connections, lets in flight requests finish, tells every client we're going away,
+// flushes their outbound queues and finally closes the storage. It gives up waiting once the shutdown timeout passes.
+func (server *ChatServer) Shutdown() error {
+	deadline := time.Now().Add(server.shutdown.Timeout)
+
+	server.lock.Lock()
+	server.shuttingDown = true
+	listeners := server.listeners
+	sessions := make([]*Session, 0, len(server.sessions))
+	for session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	server.lock.Unlock()
+
+	server.logger.Info(fmt.Sprintf("Shutting down, disconnecting %d clients", len(sessions)))
+
+	// Stop accepting new connections
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	// Let any requests we're half way through finish, so their replies go out before the notice
+	handled := make(chan bool)
+	go func() {
+		server.handlers.Wait()
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Until(deadline)):
+		server.logger.Warn("Timed out waiting for in flight requests to finish")
+	}
+
+	// Tell everyone why they're about to be disconnected, closing the queue lets it drain before the writer stops
+	// Sessions that didn't negotiate FEATURE_SHUTDOWN are told as text from SERVER
+	notice := BuildMessage(SERVER_SHUTDOWN, ServerShutdownMessage{
+		Message:       "The server is shutting down.",
+		ReconnectHint: server.shutdown.ReconnectHint,
+	})
+
+	text := "The server is shutting down."
+	if server.shutdown.ReconnectHint != "" {
+		text += " Try reconnecting to " + server.shutdown.ReconnectHint
+	}
+	textNotice := BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: text}})
+
+	for _, session := range sessions {
+		if session.HasFeature(FEATURE_SHUTDOWN) {
+			SendRemoteCommand(session, notice)
+		} else {
+			SendRemoteCommand(session, textNotice)
+		}
+		session.outbound.Close()
+	}
+
+	for _, session := range sessions {
+		select {
+		case <-session.outbound.Done():
+		case <-time.After(time.Until(deadline)):
+			server.logger.Warn("Timed out flushing a client's outbound messages")
+		}
+
+		session.connection.Close()
+	}
+
+	return server.storageManager.CloseStorage()
+}
+
+func (server *ChatServer) pingConnection(encoder Encoder, stop <-chan bool) {
+	ticker := time.NewTicker(server.connection.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := SendRemoteCommand(encoder, BuildMessage(PING, PingMessage{Time: now})); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (server *ChatServer) dropSession(session *Session) {
+	session.Close()
+
+	server.lock.Lock()
+	delete(server.sessions, session)
+	server.lock.Unlock()
+
+	if user := session.User(); user != nil {
+		server.detachSession(session, user)
+	}
+}
+
+// expelFromRoom takes the user out of the room (or its waitlist), telling them why and the rest of the room they've gone
+func (server *ChatServer) expelFromRoom(room *ServerRoom, user *ServerUser, reason string) {
+	room.RemoveFromWaitlist(user)
+
+	if err := server.roomManager.RemoveMember(room, user); err != nil {
+		// They weren't in the room, there's nobody to tell
+		return
+	}
+
+	user.Send(BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.String(), Text: reason}}))
+	user.Send(BuildMessage(LEAVE_ROOM, LeaveRoomMessage{Room: room.String()}))
+
+	server.broadcastMemberEvent(room, user, MEMBER_LEFT)
+	server.admitFromWaitlist(room)
+}
+
+// disconnectUser tells each of the user's sessions why and then drops them
+func (server *ChatServer) disconnectUser(user *ServerUser, reason string) {
+	notice := BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: reason}})
+
+	for _, session := range user.Sessions() {
+		go server.disconnectSession(session, notice)
+	}
+}
+
+// disconnectSession sends the notice and lets the session's queue drain before hanging up
+// Its connection handler notices the connection closing and drops the session as usual
+func (server *ChatServer) disconnectSession(session *Session, notice Message) {
+	SendRemoteCommand(session, notice)
+	session.outbound.Close()
+
+	select {
+	case <-session.outbound.Done():
+	case <-time.After(server.shutdown.Timeout):
+		server.logger.Warn("Timed out flushing a client's outbound messages")
+	}
+
+	session.connection.Close()
+}
+
+// SetAdmin makes the user a server wide administrator (or stops them being one), Eg. to bootstrap the first one
+func (server *ChatServer) SetAdmin(username string, admin bool) error {
+	if _, err := server.getNamedUser(username); err != nil {
+		return err
+	}
+
+	if err := server.userManager.SetAdmin(username, admin); err != nil {
+		server.logger.Error(err)
+		return errors.New("Failed to change whether " + username + " is an administrator")
+	}
+
+	return nil
+}
+
+// admitFromWaitlist lets in anyone waiting for the space(s) that just opened up, telling them and the room
+func (server *ChatServer) admitFromWaitlist(room *ServerRoom) {
+	for _, user := range server.roomManager.AdmitFromWaitlist(room) {
+		server.logger.Debug("Admitted " + user.String() + " to " + room.String() + " from the waitlist")
+
+		user.Send(BuildMessage(JOIN_ROOM, JoinRoomMessage{
+			Username: user.User.Username,
+			Room:     room.String(),
+			Status:   SUCCESS,
+			Message:  TextMessage{Text: "A space opened up, you have joined " + room.String()},
+		}))
+
+		server.broadcastMemberEvent(room, user, MEMBER_JOINED)
+	}
+}
+
+// attachSession makes sure the user's room traffic reaches the session, and hands over any direct messages they missed
+func (server *ChatServer) attachSession(session *Session, user *ServerUser) {
+	cameOnline := user.AddSession(session)
+
+	previous := session.setUser(user)
+	if previous != nil && previous != user {
+		// The connection has switched to acting as someone else
+		server.detachSession(session, previous)
+	}
+
+	if cameOnline {
+		for _, room := range server.roomManager.GetUserRooms(user) {
+			server.broadcastMemberEvent(room, user, MEMBER_ONLINE)
+		}
+
+		server.deliverDirectMessages(user)
+	}
+}
+
+// deliverDirectMessages sends the user the direct messages that were kept back while they were offline
+func (server *ChatServer) deliverDirectMessages(user *ServerUser) {
+	err := server.directMessageManager.TakeUndelivered(user, func(message DirectMessage) bool {
+		return server.sendDirectMessage(user, message.Recipient, message.TextMessage())
+	})
+
+	if err != nil {
+		server.logger.Error(err)
+	}
+}
+
+// sendDirectMessage sends a direct message to the user's sessions, those that didn't negotiate FEATURE_DIRECT get it as a RECV_MSG
+// It returns true if any of the sessions took it
+func (server *ChatServer) sendDirectMessage(user *ServerUser, recipient string, message TextMessage) bool {
+	fallback := message
+	fallback.Room = "DM to " + recipient
+
+	return user.SendWithFallback(FEATURE_DIRECT,
+		BuildMessage(RECV_DM, RecvDirectMessage{Recipient: recipient, Message: message}),
+		BuildMessage(RECV_MSG, RecvTextMessage{Message: fallback}))
+}
+
+// detachSession stops the user's room traffic reaching the session
+func (server *ChatServer) detachSession(session *Session, user *ServerUser) {
+	// Nothing changes while they're still connected from somewhere else
+	if user.RemoveSession(session) > 0 {
+		return
+	}
+
+	// That was their last session, they stay a member of their rooms but lose their place in any waitlists
+	server.roomManager.RemoveFromWaitlists(user)
+
+	for _, room := range server.roomManager.GetUserRooms(user) {
+		server.broadcastMemberEvent(room, user, MEMBER_OFFLINE)
+	}
+}
+
+// broadcastToRoom sends the message to every session of every user in the room
+func (server *ChatServer) broadcastToRoom(room *ServerRoom, message Message) {
+	for _, roomUser := range room.Users() {
+		roomUser.Send(message)
+	}
+}
+
+// broadcastMemberEvent tells everyone in the room about a change to one of its members
+// Sessions that didn't negotiate FEATURE_PRESENCE are sent the same news as text from SERVER
+func (server *ChatServer) broadcastMemberEvent(room *ServerRoom, user *ServerUser, event string) {
+	eventMessage := BuildMessage(MEMBER_EVENT, MemberEventMessage{Room: room.String(), Event: event, Member: room.Member(user)})
+
+	var text string
+	switch event {
+	case MEMBER_JOINED:
+		text = user.User.Username + " has joined!"
+	case MEMBER_LEFT:
+		text = user.User.Username + " has left!"
+	case MEMBER_ONLINE:
+		text = user.User.Username + " is online."
+	case MEMBER_OFFLINE:
+		text = user.User.Username + " has gone offline."
+	case MEMBER_ROLE:
+		switch room.Role(user) {
+		case ROLE_OWNER:
+			text = user.User.Username + " is now the owner."
+		case ROLE_MODERATOR:
+			text = user.User.Username + " is now a moderator."
+		default:
+			text = user.User.Username + " is no longer a moderator."
+		}
+	}
+
+	textMessage := BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.String(), Text: text}})
+
+	server.broadcastToRoomWithFallback(room, FEATURE_PRESENCE, eventMessage, textMessage)
+}
+
+// broadcastToRoomWithFallback sends the message to the sessions in the room that negotiated the feature, and the fallback to the rest
+func (server *ChatServer) broadcastToRoomWithFallback(room *ServerRoom, feature string, message Message, fallback Message) {
+	for _, roomUser := range room.Users() {
+		roomUser.SendWithFallback(feature, message, fallback)
+	}
+}
+
+func (server *ChatServer) handshake(codec Codec) (HelloMessage, error) {
+	message := Message{}
+	if err := codec.Decode(&message); err != nil {
+		return HelloMessage{}, err
+	}
+
+	var reply HelloMessage
+
+	if hello, ok := message.Contents.(HelloMessage); message.Command == HELLO && ok {
+		reply = NegotiateHello(hello)
+		reply.PingInterval = int(server.connection.PingInterval / time.Second)
+	} else {
+		reply = HelloMessage{
+			Version:  PROTOCOL_VERSION,
+			Features: SUPPORTED_FEATURES,
+			Status:   FAILURE,
+			Message:  "Expected a HELLO message but received '" + string(message.Command) + "', please upgrade your client",
+		}
+	}
+
+	if err := SendRemoteCommand(codec, BuildMessage(HELLO, reply)); err != nil {
+		return HelloMessage{}, err
+	}
+
+	if reply.Status != SUCCESS {
+		return HelloMessage{}, errors.New(reply.Message)
+	}
+
+	server.logger.Debug(fmt.Sprintf("Negotiated protocol version %d with features %v", reply.Version, reply.Features))
+	return reply, nil
+}
+
+func (server *ChatServer) HandleMessage(message Message, session *Session) (Message, error) {
+	// Make sure the Contents are what the Command says they are before anything type asserts them
+	if expected, ok := COMMAND_CONTENTS[message.Command]; !ok {
+		return server.errorReply(message.Command, NewChatError(UNKNOWN_COMMAND, "Unknown command '"+string(message.Command)+"'")), nil
+	} else if reflect.TypeOf(message.Contents) != reflect.TypeOf(expected) {
+		return server.errorReply(message.Command, NewChatError(BAD_REQUEST, "Unexpected contents for a '"+string(message.Command)+"' message")), nil
+	}
+
+	// If the Message provides a Token, ensure it's valid
+	if err := server.checkTokenIfRequired(message, session); err != nil {
+		return server.errorReply(message.Command, err), nil
+	}
+	// We assume now that any requests that require a Token are valid (authenticated)
+
+	// Get the Room if this Message contains one
+	// This saves us having the same Room extraction code for each Message type
+	room, err := server.getRoomIfRequired(message)
+	if err != nil {
+		return server.errorReply(message.Command, err), nil
+	}
+
+	// Get the user if this Message has one
+	// This saves us having the same user extraction code for each Message type
+	user, err := server.getUserIfRequired(message, session)
+	if err != nil {
+		return server.errorReply(message.Command, err), nil
+	}
+
+	// Interpret Message
+	switch message.Command {
+	case PING:
+		return BuildMessage(PONG, message.Contents), nil
+
+	case REGISTER:
+		contents := message.Contents.(RegisterMessage)
+
+		if err := server.userManager.CreateUser(contents.Username, contents.PasswordHash); err != nil {
+			server.logger.Error("Sending back failed registration attempt")
+			server.logger.Error(err)
+
+			if err != ErrUsernameTaken {
+				err = errors.New("Registration Failed.")
+			}
+
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.logger.Debug("Sending back successfull registration attempt")
+		textMessage := TextMessage{Username: "SERVER", Room: "SERVER", Text: "Registration Successfull."}
+		return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
+
+	case AUTHENTICATE:
+		contents := message.Contents.(AuthenticateMessage)
+		user, err := server.userManager.AuthenticateUser(contents.Username, contents.PasswordHash)
+
+		if err != nil {
+			server.logger.Debug("Sending back failed authentication attempt")
+			server.logger.Error(err)
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// From now on this connection acts as the user, whatever usernames it puts in later messages
+		server.attachSession(session, user)
+
+		// Let the client know which rooms it can pick back up
+		rooms, err := server.roomManager.GetUserRoomNames(user)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.logger.Debug("Sending back successful authentication attempt")
+		msg := "Authentication Successful!"
+		return BuildMessage(TOKEN, TokenMessage{Username: user.User.Username, Token: user.GetToken(), Message: msg, Rooms: rooms, Admin: user.IsAdmin()}), nil
+
+	case LIST_ROOMS:
+		// Only list the rooms the caller is allowed to know about
+		names := []string{}
+		infos := []RoomInfo{}
+		for _, room := range server.roomManager.GetRooms() {
+			if server.canSeeRoom(room, session.User()) {
+				names = append(names, room.String())
+				infos = append(infos, room.Info())
+			}
+		}
+
+		// Version 1 clients only know about the names
+		if session.Version() < 2 {
+			return BuildMessage(LIST_ROOMS, ListRoomsMessage{Rooms: names}), nil
+		}
+
+		return BuildMessage(LIST_ROOMS, ListRoomsMessage{Rooms: names, RoomInfos: infos}), nil
+
+	case LIST_MEMBERS:
+		if err := server.checkCanSeeInside(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(LIST_MEMBERS, ListMembersMessage{Room: room.String(), Members: room.Members()}), nil
+
+	case SEND_MSG:
+		contents := message.Contents.(SendTextMessage)
+
+		// Only members get to talk, which also keeps out anyone banned as a ban takes them out of the room
+		if !room.HasUser(user) {
+			return server.errorReply(message.Command, NewChatError(NOT_IN_ROOM, "You need to join "+room.String()+" first")), nil
+		}
+
+		if err := server.checkNotSanctioned(room, user, SANCTION_MUTE); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Only the text (and what it's replying to) comes from the client, we say who sent it, where and when
+		textMessage := TextMessage{Username: user.User.Username, Room: room.String(), Text: contents.Message.Text, Time: time.Now(), ReplyTo: contents.Message.ReplyTo}
+
+		// Replies have to be to a message in the same room
+		if textMessage.ReplyTo != 0 {
+			if _, err := server.messageManager.GetRoomMessage(room, textMessage.ReplyTo); err != nil {
+				return server.errorReply(message.Command, err), nil
+			}
+		}
+
+		// Persist the message
+		id, err := server.messageManager.PersistRoomMessage(user, room, textMessage.Text, textMessage.Time, textMessage.ReplyTo)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		textMessage.Id = id
+
+		// Send the message to each user in the room
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}))
+
+		// The sender has obviously read it, everyone else only has once they fetch it with POP_MSGS
+		server.roomManager.MarkRead(room, id, user)
+
+	case JOIN_ROOM:
+		if room.Room.Name == "" {
+			return server.errorReply(message.Command, ErrRoomDoesNotExist), nil
+		}
+
+		contents := message.Contents.(JoinRoomMessage)
+
+		if err := server.checkNotSanctioned(room, user, SANCTION_BAN); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.checkCanJoin(room, user, contents.PasswordHash); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Membership is per user and lasts until they leave, joining again just confirms they're in
+		added, err := server.roomManager.AddMember(room, user)
+		if err != nil {
+			if err == ErrRoomIsFull && contents.Waitlist {
+				position := room.Waitlist(user)
+
+				return BuildMessage(JOIN_ROOM, JoinRoomMessage{
+					Username: user.User.Username,
+					Room:     room.String(),
+					Status:   WAITLISTED,
+					Message:  TextMessage{Text: fmt.Sprintf("%s is full, you are number %d on the waitlist", room.String(), position)},
+				}), nil
+			}
+
+			server.logger.Debug(err)
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if added {
+			// Let everyone in the room know
+			server.broadcastMemberEvent(room, user, MEMBER_JOINED)
+		}
+
+		return BuildMessage(JOIN_ROOM, JoinRoomMessage{
+			Username: user.User.Username,
+			Room:     room.String(),
+			Status:   SUCCESS,
+			Message:  TextMessage{Text: "Successfully joined " + room.String()},
+		}), nil
+
+	case LEAVE_ROOM:
+		if err := server.roomManager.RemoveMember(room, user); err != nil {
+			// Leaving a room you're waiting to get into just gives up your place in the queue
+			if room.RemoveFromWaitlist(user) {
+				return BuildMessage(LEAVE_ROOM, LeaveRoomMessage{
+					Username: user.User.Username,
+					Room:     room.String(),
+					Status:   SUCCESS,
+					Message:  TextMessage{Text: "Successfully left the waitlist for " + room.String()},
+				}), nil
+			}
+
+			server.logger.Error(err)
+			return server.errorReply(message.Command, NewChatError(NOT_IN_ROOM, "You are not in "+room.String())), nil
+		}
+
+		server.broadcastMemberEvent(room, user, MEMBER_LEFT)
+		server.admitFromWaitlist(room)
+
+		return BuildMessage(LEAVE_ROOM, LeaveRoomMessage{
+			Username: user.User.Username,
+			Room:     room.String(),
+			Status:   SUCCESS,
+			Message:  TextMessage{Text: "Successfully left " + room.String()},
+		}), nil
+
+	case CREATE_ROOM:
+		contents := message.Contents.(CreateRoomMessage)
+
+		if room.Room.Name != "" {
+			return server.errorReply(message.Command, NewChatError(ROOM_EXISTS, "Room already exists!")), nil
+		}
+
+		if contents.Access == "" {
+			contents.Access = ACCESS_PUBLIC
+		}
+
+		if err := checkAccess(contents.Access, contents.PasswordHash); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if _, err := server.roomManager.CreateRoom(contents.Room, contents.Capacity, contents.Access, contents.PasswordHash, user); err != nil {
+			server.logger.Debug("Failed to create room '" + contents.Room + "'")
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Failed to create room: "+contents.Room)), nil
+		}
+
+		textMessage := TextMessage{Username: "SERVER", Room: "SERVER", Text: "Successfully created room: " + contents.Room}
+		return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
+
+	case SET_ACCESS:
+		contents := message.Contents.(SetAccessMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := checkAccess(contents.Access, contents.PasswordHash); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.roomManager.SetAccess(room, contents.Access, contents.PasswordHash); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		accessMessage := TextMessage{Username: "SERVER", Room: room.String(), Text: user.User.Username + " changed who can join to: " + contents.Access}
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: accessMessage}))
+
+		return BuildMessage(SET_ACCESS, SetAccessMessage{Room: room.String(), Access: contents.Access, Status: SUCCESS}), nil
+
+	case INVITE:
+		contents := message.Contents.(InviteMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.roomManager.AddInvite(room, target, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target.Send(BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{
+			Username: "SERVER", Room: "SERVER", Text: user.User.Username + " has invited you to join " + room.String(),
+		}}))
+
+		return BuildMessage(INVITE, InviteMessage{Room: room.String(), Username: target.User.Username, Status: SUCCESS}), nil
+
+	case UNINVITE:
+		contents := message.Contents.(UninviteMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Taking back the invite doesn't throw them out if they've already joined, that's what KICK is for
+		removed, err := server.roomManager.RemoveInvite(room, target)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if !removed {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, target.String()+" hasn't been invited to "+room.String())), nil
+		}
+
+		return BuildMessage(UNINVITE, UninviteMessage{Room: room.String(), Username: target.User.Username, Status: SUCCESS}), nil
+
+	case SET_TOPIC:
+		contents := message.Contents.(SetTopicMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.roomManager.SetTopic(room, contents.Topic); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		topicMessage := TextMessage{Username: "SERVER", Room: room.String(), Text: user.User.Username + " changed the topic to: " + contents.Topic}
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: topicMessage}))
+
+		return BuildMessage(SET_TOPIC, SetTopicMessage{Room: room.String(), Topic: contents.Topic, Status: SUCCESS}), nil
+
+	case SET_DESCRIPTION:
+		contents := message.Contents.(SetDescriptionMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.roomManager.SetDescription(room, contents.Description); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		descriptionMessage := TextMessage{Username: "SERVER", Room: room.String(), Text: user.User.Username + " changed the description to: " + contents.Description}
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: descriptionMessage}))
+
+		return BuildMessage(SET_DESCRIPTION, SetDescriptionMessage{Room: room.String(), Description: contents.Description, Status: SUCCESS}), nil
+
+	case GRANT_ROLE:
+		contents := message.Contents.(GrantRoleMessage)
+
+		if err := server.checkIsOwner(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Ownership changes hands through TRANSFER_OWNER, moderator is the only role that can be granted
+		if contents.Role != ROLE_MODERATOR {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, "Only the "+ROLE_MODERATOR+" role can be granted")), nil
+		}
+
+		member, err := server.getRoomMember(room, contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if room.IsOwner(member) {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, member.User.Username+" already owns "+room.String())), nil
+		}
+
+		if err := server.roomManager.SetRole(room, member, ROLE_MODERATOR); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.broadcastMemberEvent(room, member, MEMBER_ROLE)
+
+		return BuildMessage(GRANT_ROLE, GrantRoleMessage{Room: room.String(), Username: member.User.Username, Role: ROLE_MODERATOR, Status: SUCCESS}), nil
+
+	case REVOKE_ROLE:
+		contents := message.Contents.(RevokeRoleMessage)
+
+		if err := server.checkIsOwner(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		member, err := server.getRoomMember(room, contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if room.IsOwner(member) {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, "The owner's role can only change by transferring ownership")), nil
+		}
+
+		if err := server.roomManager.SetRole(room, member, ROLE_MEMBER); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.broadcastMemberEvent(room, member, MEMBER_ROLE)
+
+		return BuildMessage(REVOKE_ROLE, RevokeRoleMessage{Room: room.String(), Username: member.User.Username, Status: SUCCESS}), nil
+
+	case TRANSFER_OWNER:
+		contents := message.Contents.(TransferOwnerMessage)
+
+		if err := server.checkIsOwner(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		member, err := server.getRoomMember(room, contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// An administrator handing over a room without an owner yet has nobody to step down
+		previous := room.Owner()
+
+		if err := server.roomManager.TransferOwnership(room, member, previous); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.broadcastMemberEvent(room, member, MEMBER_ROLE)
+		if previous != nil && previous != member {
+			server.broadcastMemberEvent(room, previous, MEMBER_ROLE)
+		}
+
+		return BuildMessage(TRANSFER_OWNER, TransferOwnerMessage{Room: room.String(), Username: member.User.Username, Status: SUCCESS}), nil
+
+	case KICK:
+		contents := message.Contents.(KickMessage)
+
+		target, err := server.getRoomMember(room, contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.checkCanSanction(room, user, target); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		sanction, err := server.sanctionManager.AddSanction(room, target, user, SANCTION_KICK, contents.Reason, 0)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.expelFromRoom(room, target, "You have been kicked from "+room.String()+" by "+user.String()+describeSanction(sanction))
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{
+			Username: "SERVER", Room: room.String(), Text: target.String() + " was kicked by " + user.String() + describeSanction(sanction),
+		}}))
+
+		return BuildMessage(KICK, KickMessage{Room: room.String(), Username: target.User.Username, Reason: contents.Reason, Status: SUCCESS}), nil
+
+	case BAN:
+		contents := message.Contents.(BanMessage)
+
+		// Users can be banned before they've ever joined
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.checkCanSanction(room, user, target); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := checkSanctionDuration(contents.Duration); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		sanction, err := server.sanctionManager.AddSanction(room, target, user, SANCTION_BAN, contents.Reason, time.Duration(contents.Duration)*time.Second)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.expelFromRoom(room, target, "You have been banned from "+room.String()+" by "+user.String()+describeSanction(sanction))
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{
+			Username: "SERVER", Room: room.String(), Text: target.String() + " was banned by " + user.String() + describeSanction(sanction),
+		}}))
+
+		return BuildMessage(BAN, BanMessage{
+			Room:     room.String(),
+			Username: target.User.Username,
+			Reason:   contents.Reason,
+			Duration: contents.Duration,
+			Expires:  sanction.Expires(),
+			Status:   SUCCESS,
+		}), nil
+
+	case UNBAN:
+		contents := message.Contents.(UnbanMessage)
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.liftSanctions(room, user, target, SANCTION_BAN); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(UNBAN, UnbanMessage{Room: room.String(), Username: target.User.Username, Status: SUCCESS}), nil
+
+	case MUTE:
+		contents := message.Contents.(MuteMessage)
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.checkCanSanction(room, user, target); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := checkSanctionDuration(contents.Duration); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		sanction, err := server.sanctionManager.AddSanction(room, target, user, SANCTION_MUTE, contents.Reason, time.Duration(contents.Duration)*time.Second)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Muted users stay in the room, so they hear about it along with everyone else
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{
+			Username: "SERVER", Room: room.String(), Text: target.String() + " was muted by " + user.String() + describeSanction(sanction),
+		}}))
+
+		return BuildMessage(MUTE, MuteMessage{
+			Room:     room.String(),
+			Username: target.User.Username,
+			Reason:   contents.Reason,
+			Duration: contents.Duration,
+			Expires:  sanction.Expires(),
+			Status:   SUCCESS,
+		}), nil
+
+	case UNMUTE:
+		contents := message.Contents.(UnmuteMessage)
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.liftSanctions(room, user, target, SANCTION_MUTE); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.broadcastToRoom(room, BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{
+			Username: "SERVER", Room: room.String(), Text: target.String() + " was unmuted by " + user.String(),
+		}}))
+
+		return BuildMessage(UNMUTE, UnmuteMessage{Room: room.String(), Username: target.User.Username, Status: SUCCESS}), nil
+
+	case DISCONNECT_USER:
+		contents := message.Contents.(DisconnectUserMessage)
+
+		if err := server.checkIsAdmin(user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		server.logger.Info(user.String() + " disconnected " + target.String())
+		server.disconnectUser(target, "You have been disconnected by an administrator.")
+
+		return BuildMessage(DISCONNECT_USER, DisconnectUserMessage{Username: target.User.Username, Status: SUCCESS}), nil
+
+	case RESET_PASSWORD:
+		contents := message.Contents.(ResetPasswordMessage)
+
+		if err := server.checkIsAdmin(user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.userManager.UpdatePassword(target.User.Username, contents.PasswordHash); err != nil {
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Failed to reset the password of "+target.User.Username)), nil
+		}
+
+		// Their token has changed so log them out everywhere, apart from the session asking if they reset their own
+		notice := BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: "Your password has been reset by an administrator."}})
+		for _, targetSession := range target.Sessions() {
+			if targetSession != session {
+				go server.disconnectSession(targetSession, notice)
+			}
+		}
+
+		server.logger.Info(user.String() + " reset the password of " + target.String())
+		reply := ResetPasswordMessage{Username: target.User.Username, Status: SUCCESS}
+		if target == user {
+			reply.Token = target.GetToken()
+		}
+
+		return BuildMessage(RESET_PASSWORD, reply), nil
+
+	case DELETE_USER:
+		contents := message.Contents.(DeleteUserMessage)
+
+		if err := server.checkIsAdmin(user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		target, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// Deleted users aren't members of anything, let everyone know they've gone and fill the spaces they leave behind
+		for _, room := range server.roomManager.GetUserRooms(target) {
+			if err := server.roomManager.RemoveMember(room, target); err != nil {
+				server.logger.Error(err)
+				continue
+			}
+
+			server.broadcastMemberEvent(room, target, MEMBER_LEFT)
+			server.admitFromWaitlist(room)
+		}
+
+		server.roomManager.RemoveFromWaitlists(target)
+
+		if err := server.userManager.DeleteUser(target.User.Username); err != nil {
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Failed to delete "+target.User.Username)), nil
+		}
+
+		server.logger.Info(user.String() + " deleted " + target.String())
+		server.disconnectUser(target, "Your account has been deleted.")
+
+		return BuildMessage(DELETE_USER, DeleteUserMessage{Username: target.User.Username, Status: SUCCESS}), nil
+
+	case SET_ADMIN:
+		contents := message.Contents.(SetAdminMessage)
+
+		if err := server.checkIsAdmin(user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.SetAdmin(contents.Username, contents.Admin); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(SET_ADMIN, SetAdminMessage{Username: contents.Username, Admin: contents.Admin, Status: SUCCESS}), nil
+
+	case CLOSE_ROOM:
+		contents := message.Contents.(CloseRoomMessage)
+
+		if err := server.checkCanModerate(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		room, err := server.roomManager.CloseRoom(contents.Room)
+		if err != nil {
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Failed to close room: "+contents.Room)), nil
+		}
+
+		// Notify all users that the room has been closed
+		for _, user := range room.Users() {
+			user.Send(BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.Room.Name, Text: "This room has been closed."}}))
+			user.Send(BuildMessage(LEAVE_ROOM, LeaveRoomMessage{Room: room.Room.Name}))
+		}
+
+		textMessage := TextMessage{Username: "SERVER", Room: "SERVER", Text: "Successfully closed room: " + room.Room.Name}
+		return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
+	case POP_MSGS:
+		contents := message.Contents.(PopulateMessages)
+
+		if err := server.checkCanSeeInside(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		var timeSince int64
+		timeSince = int64(contents.TimeSince)
+
+		if contents.Limit == 0 {
+			// Default it to something useful
+			contents.Limit = 50
+		}
 
-	userManager, err := NewUserManager(storageManager, logger)
-	if err != nil {
-		return &ChatServer{}, err
-	}
+		// Only members have a last-read marker, anyone else looking in gets the history from TimeSince
+		member := room.HasUser(user)
 
-	roomManager, err := NewRoomManager(storageManager, logger)
-	if err != nil {
-		return &ChatServer{}, err
+		var lastRead int64
+		if contents.SinceLastRead && member {
+			if lastRead, err = server.roomManager.GetLastRead(room, user); err != nil {
+				return server.errorReply(message.Command, err), nil
+			}
+		}
+
+		var messages []TextMessage
+		var lastId int64
+
+		if lastRead > 0 {
+			messages, lastId, err = server.messageManager.GetRoomMessagesAfter(room, lastRead, contents.Limit)
+		} else {
+			messages, lastId, err = server.messageManager.GetRoomMessagesSince(room, time.Unix(timeSince, 0), contents.Limit)
+		}
+
+		if err != nil {
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Unable to obtain the rooms messages")), nil
+		}
+
+		if member && lastId > 0 {
+			server.roomManager.MarkRead(room, lastId, user)
+		}
+
+		return BuildMessage(POP_MSGS, PopulateMessages{Room: room.String(), Messages: messages}), nil
+
+	case EDIT_MSG:
+		contents := message.Contents.(EditTextMessage)
+
+		if contents.Message.Text == "" {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, "A message can't be edited to nothing, delete it instead")), nil
+		}
+
+		textMessage, err := server.getChangeableMessage(room, user, contents.Message.Id)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.messageManager.EditRoomMessage(room, textMessage.Id, contents.Message.Text); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		textMessage.Text = contents.Message.Text
+		textMessage.Edited = true
+
+		// Clients that don't know about edits are told as text from SERVER
+		text := fmt.Sprintf("%s edited message #%d: %s", textMessage.Username, textMessage.Id, textMessage.Text)
+		server.broadcastToRoomWithFallback(room, FEATURE_EDITS,
+			BuildMessage(EDIT_MSG, EditTextMessage{Message: textMessage}),
+			BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.String(), Text: text}}))
+
+		return BuildMessage(EDIT_MSG, EditTextMessage{Message: textMessage, Status: SUCCESS}), nil
+
+	case DELETE_MSG:
+		contents := message.Contents.(DeleteTextMessage)
+
+		textMessage, err := server.getChangeableMessage(room, user, contents.Message.Id)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if err := server.messageManager.DeleteRoomMessage(room, textMessage.Id); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		textMessage.Text = ""
+		textMessage.Deleted = true
+
+		text := fmt.Sprintf("Message #%d from %s was deleted", textMessage.Id, textMessage.Username)
+		server.broadcastToRoomWithFallback(room, FEATURE_EDITS,
+			BuildMessage(DELETE_MSG, DeleteTextMessage{Message: textMessage}),
+			BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.String(), Text: text}}))
+
+		return BuildMessage(DELETE_MSG, DeleteTextMessage{Message: textMessage, Status: SUCCESS}), nil
+
+	case GET_THREAD:
+		contents := message.Contents.(GetThreadMessage)
+
+		if err := server.checkCanSeeInside(room, user); err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		messages, err := server.messageManager.GetThread(room, contents.Id)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(GET_THREAD, GetThreadMessage{Room: room.String(), Id: contents.Id, Messages: messages}), nil
+
+	case SEND_DM:
+		contents := message.Contents.(SendDirectMessage)
+
+		recipient, err := server.getNamedUser(contents.Recipient)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if recipient == user {
+			return server.errorReply(message.Command, NewChatError(BAD_REQUEST, "You can't send a direct message to yourself")), nil
+		}
+
+		// Only the text comes from the client, we say who sent it and when
+		textMessage := TextMessage{Username: user.User.Username, Text: contents.Message.Text, Time: time.Now()}
+
+		// The recipient gets theirs now if any of their sessions takes it, otherwise when they next come online
+		err = server.directMessageManager.PersistDirectMessage(user, recipient, textMessage.Text, textMessage.Time, func() bool {
+			return server.sendDirectMessage(recipient, recipient.User.Username, textMessage)
+		})
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		// The sender's other connections get a copy too
+		server.sendDirectMessage(user, recipient.User.Username, textMessage)
+
+	case POP_DMS:
+		contents := message.Contents.(PopulateDirectMessages)
+
+		other, err := server.getNamedUser(contents.Username)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		if contents.Limit == 0 {
+			// Default it to something useful
+			contents.Limit = 50
+		}
+
+		messages, err := server.directMessageManager.GetDirectMessagesSince(user, other, time.Unix(int64(contents.TimeSince), 0), contents.Limit)
+		if err != nil {
+			server.logger.Error(err)
+			return server.errorReply(message.Command, errors.New("Unable to obtain the direct messages")), nil
+		}
+
+		return BuildMessage(POP_DMS, PopulateDirectMessages{Username: other.User.Username, Messages: messages}), nil
+
+	case LIST_DMS:
+		conversations, err := server.directMessageManager.GetConversations(user)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(LIST_DMS, ListDirectMessagesMessage{Conversations: conversations}), nil
+
+	case UNREAD:
+		counts, err := server.messageManager.GetUnreadCounts(user)
+		if err != nil {
+			return server.errorReply(message.Command, err), nil
+		}
+
+		return BuildMessage(UNREAD, UnreadMessage{Rooms: counts}), nil
 	}
 
-	messageManager, err := NewRoomMessageManager(storageManager, roomManager, userManager, logger)
-	if err != nil {
-		return &ChatServer{}, err
+	return Message{}, nil
+}
+
+// checkCanModerate only lets the owner, moderators and administrators close a room or change its settings
+// Rooms created before owners were recorded are left to the administrators
+func (server *ChatServer) checkCanModerate(room *ServerRoom, user *ServerUser) error {
+	if user.IsAdmin() {
+		return nil
 	}
 
-	chat_server := ChatServer{
-		userManager:    userManager,
-		roomManager:    roomManager,
-		messageManager: messageManager,
-		logger:         logger,
+	if role := room.Role(user); role == ROLE_OWNER || role == ROLE_MODERATOR {
+		return nil
 	}
 
-	return &chat_server, nil
+	return NewChatError(PERMISSION_DENIED, "Only the owner or a moderator of "+room.String()+" can do that")
 }
 
-func (server ChatServer) Listen(connection_string string) error {
-	// Bind to the IP/Port and listen for new incoming connections
-	socket, err := net.Listen("tcp", connection_string)
-	if err != nil {
-		return err
+// checkIsOwner only lets the owner (or an administrator) hand out roles, so only an administrator can give a room without one an owner
+func (server *ChatServer) checkIsOwner(room *ServerRoom, user *ServerUser) error {
+	if user.IsAdmin() || room.IsOwner(user) {
+		return nil
 	}
 
-	server.logger.Info("Listening on " + connection_string)
+	return NewChatError(PERMISSION_DENIED, "Only the owner of "+room.String()+" can do that")
+}
 
-	for {
-		connection, err := socket.Accept()
-		if err != nil {
-			server.logger.Error("Unable to accept connection correctly.")
+// checkAccess makes sure the access mode is one we know, and that password rooms are given a password
+func checkAccess(access string, password string) error {
+	switch access {
+	case ACCESS_PUBLIC, ACCESS_UNLISTED, ACCESS_INVITE:
+		return nil
+	case ACCESS_PASSWORD:
+		if password == "" {
+			return NewChatError(BAD_REQUEST, "Password protected rooms need a password")
 		}
 
-		server.logger.Info("Accepted incoming connection")
-		go server.HandleIncomingConnection(connection)
+		return nil
 	}
+
+	return NewChatError(BAD_REQUEST, "Unknown room access '"+access+"'")
 }
 
-func (server *ChatServer) HandleIncomingConnection(connection net.Conn) {
-	var empty_message Message
-	encoder := gob.NewEncoder(connection)
-	decoder := gob.NewDecoder(connection)
+// privileged users get into any room whatever its access, user may be nil if the session hasn't authenticated
+func (server *ChatServer) privileged(room *ServerRoom, user *ServerUser) bool {
+	return user != nil && (user.IsAdmin() || room.IsOwner(user) || room.HasUser(user))
+}
 
-	for {
-		message := Message{}
-		decoder.Decode(&message)
+// canSeeRoom decides whether LIST_ROOMS tells the user about the room
+func (server *ChatServer) canSeeRoom(room *ServerRoom, user *ServerUser) bool {
+	access := room.Access()
+	if access == ACCESS_PUBLIC || access == ACCESS_PASSWORD || server.privileged(room, user) {
+		return true
+	}
 
-		if message == empty_message {
-			time.Sleep(time.Second * 1)
-			continue
+	// Unlisted rooms stay hidden from everyone else, invite only rooms are shown to those invited
+	if access == ACCESS_INVITE && user != nil {
+		invited, err := server.roomManager.IsInvited(room, user)
+		return err == nil && invited
+	}
+
+	return false
+}
+
+// checkCanJoin enforces the room's access mode, members joining again are let straight through
+func (server *ChatServer) checkCanJoin(room *ServerRoom, user *ServerUser, password string) error {
+	if server.privileged(room, user) {
+		return nil
+	}
+
+	switch room.Access() {
+	case ACCESS_PASSWORD:
+		matches, err := server.roomManager.CheckPassword(room, password)
+		if err != nil {
+			return err
 		}
 
-		server.logger.Debug("Handling incoming " + message.Command + " message.")
-		reply, err := server.HandleMessage(message, encoder)
+		if !matches {
+			return NewChatError(WRONG_PASSWORD, "You need the right password to join "+room.String())
+		}
+	case ACCESS_INVITE:
+		invited, err := server.roomManager.IsInvited(room, user)
 		if err != nil {
-			server.logger.Error(err)
-			return
-		} else if reply.Command != "" {
-			// Only send a reply if the command is not empty
-			server.logger.Debug("Sending " + reply.Command + " response.")
-			encoder.Encode(reply)
+			return err
+		}
+
+		if !invited {
+			return NewChatError(NOT_INVITED, "You need an invite to join "+room.String())
 		}
 	}
+
+	return nil
 }
 
-func (server *ChatServer) HandleMessage(message Message, encoder *gob.Encoder) (Message, error) {
-	// If the Message provides a Token, ensure it's valid
-	passes, err := server.messagePassesTokenTest(message)
-	if err != nil {
-		return Message{}, err
+// checkCanSeeInside keeps everything but public rooms' members and messages to those in them
+// Anyone can look in on a public room from outside, except those banned from it
+func (server *ChatServer) checkCanSeeInside(room *ServerRoom, user *ServerUser) error {
+	if user.IsAdmin() || room.HasUser(user) {
+		return nil
 	}
 
-	if !passes {
-		return Message{}, errors.New("Token is invalid")
+	if room.Access() != ACCESS_PUBLIC {
+		return NewChatError(NOT_IN_ROOM, "You need to join "+room.String()+" first")
 	}
-	// We assume now that any requests that require a Token are valid (authenticated)
 
-	// Get the Room if this Message contains one
-	// This saves us having the same Room extraction code for each Message type
-	room, err := server.getRoomIfRequired(message)
-	if err != nil {
-		return BuildMessage(
-			RECV_MSG,
-			RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: err.Error()}},
-		), nil
+	return server.checkNotSanctioned(room, user, SANCTION_BAN)
+}
+
+// rank orders how much say a user has over a room, nobody can sanction someone of the same or a higher rank
+func (server *ChatServer) rank(room *ServerRoom, user *ServerUser) int {
+	if user.IsAdmin() {
+		return 3
 	}
 
-	// Get the user if this Message has one
-	// This saves us having the same user extraction code for each Message type
-	user, err := server.getUserIfRequired(message, encoder)
-	if err != nil {
-		return BuildMessage(
-			RECV_MSG,
-			RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: err.Error()}},
-		), nil
+	switch room.Role(user) {
+	case ROLE_OWNER:
+		return 2
+	case ROLE_MODERATOR:
+		return 1
 	}
 
-	// Interpret Message
-	switch message.Command {
-	case REGISTER:
-		contents := message.Contents.(RegisterMessage)
+	return 0
+}
 
-		var message TextMessage
-		if err := server.userManager.CreateUser(contents.Username, contents.PasswordHash); err != nil {
-			server.logger.Error("Sending back failed registration attempt")
-			server.logger.Error(err)
-			message = TextMessage{Username: "SERVER", Room: "SERVER", Text: "Registration Failed."}
-		} else {
-			server.logger.Debug("Sending back successfull registration attempt")
-			message = TextMessage{Username: "SERVER", Room: "SERVER", Text: "Registration Successfull."}
-		}
+// checkSanctionDuration refuses negative durations rather than let them turn into permanent sanctions like 0 does
+func checkSanctionDuration(duration int) error {
+	if duration < 0 {
+		return NewChatError(BAD_REQUEST, "The duration can't be negative, use 0 to make it permanent")
+	}
 
-		return BuildMessage(RECV_MSG, RecvTextMessage{Message: message}), nil
+	return nil
+}
 
-	case AUTHENTICATE:
-		contents := message.Contents.(AuthenticateMessage)
-		user, err := server.userManager.AuthenticateUser(contents.Username, contents.PasswordHash)
+// checkCanSanction lets moderators kick, ban and mute members, the owner do the same to moderators and so on
+func (server *ChatServer) checkCanSanction(room *ServerRoom, user *ServerUser, target *ServerUser) error {
+	if err := server.checkCanModerate(room, user); err != nil {
+		return err
+	}
 
-		var tokenMessage TokenMessage
-		if err != nil {
-			server.logger.Debug("Sending back failed authentication attempt")
-			server.logger.Error(err)
-			msg := "Authentication Failed: " + err.Error()
-			tokenMessage = TokenMessage{Username: contents.Username, Token: "", Message: msg}
-		} else {
-			server.logger.Debug("Sending back successful authentication attempt")
-			msg := "Authentication Successful!"
-			tokenMessage = TokenMessage{Username: user.User.Username, Token: user.GetToken(), Message: msg}
-		}
+	if user == target {
+		return NewChatError(BAD_REQUEST, "You can't do that to yourself")
+	}
 
-		return BuildMessage(TOKEN, tokenMessage), nil
+	if server.rank(room, target) >= server.rank(room, user) {
+		return NewChatError(PERMISSION_DENIED, "You can't do that to "+target.String()+", they outrank or equal you in "+room.String())
+	}
 
-	case LIST_ROOMS:
-		return BuildMessage(LIST_ROOMS, ListRoomsMessage{Rooms: server.roomManager.GetRoomNames()}), nil
+	return nil
+}
 
-	case SEND_MSG:
-		contents := message.Contents.(SendTextMessage)
+// checkNotSanctioned fails if the user is currently banned from (or muted in) the room
+func (server *ChatServer) checkNotSanctioned(room *ServerRoom, user *ServerUser, kind string) error {
+	sanction, active, err := server.sanctionManager.GetActiveSanction(room, user, kind)
+	if err != nil || !active {
+		return err
+	}
 
-		// Persist the message
-		server.messageManager.PersistRoomMessage(user, room, contents.Message.Text)
+	if kind == SANCTION_MUTE {
+		return NewChatError(MUTED, "You are muted in "+room.String()+describeSanction(sanction))
+	}
 
-		// Send the message to each user in the room
-		roomMessage := BuildMessage(RECV_MSG, RecvTextMessage{Message: contents.Message})
-		for _, roomUser := range room.users {
-			SendRemoteCommand(roomUser.encoder, roomMessage)
-		}
+	return NewChatError(BANNED, "You are banned from "+room.String()+describeSanction(sanction))
+}
 
-	case JOIN_ROOM:
-		joinMessage := JoinRoomMessage{Username: user.User.Username}
+// liftSanctions ends the target's bans or mutes in the room early
+func (server *ChatServer) liftSanctions(room *ServerRoom, user *ServerUser, target *ServerUser, kind string) error {
+	if err := server.checkCanModerate(room, user); err != nil {
+		return err
+	}
 
-		if room.Room.Name == "" {
-			joinMessage.Room = "N/A"
-			joinMessage.Status = FAILURE
-			joinMessage.Message = TextMessage{Text: "Room doesn't exist"}
-		} else {
-			joinMessage.Room = room.String()
+	lifted, err := server.sanctionManager.LiftSanctions(room, target, kind)
+	if err != nil {
+		return err
+	}
 
-			if err := room.AddUser(user); err != nil {
-				server.logger.Error(err)
-				joinMessage.Status = FAILURE
-				joinMessage.Message = TextMessage{Text: err.Error()}
-			} else {
-				joinMessage.Status = SUCCESS
-				joinMessage.Message = TextMessage{Text: "Successfully joined " + room.String()}
+	if !lifted {
+		return NewChatError(BAD_REQUEST, target.String()+" has no "+kind+" to lift in "+room.String())
+	}
 
-				// Send the message to each user in the room
-				joinedMessage := BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: "SERVER", Text: user.User.Username + " has joined!"}})
-				for _, roomUser := range room.users {
-					SendRemoteCommand(roomUser.encoder, joinedMessage)
-				}
-			}
-		}
+	return nil
+}
 
-		return BuildMessage(JOIN_ROOM, joinMessage), nil
+// describeSanction is appended to the text telling people about the sanction, Eg. " until 02 Jan 06 15:04 UTC: Spamming"
+func describeSanction(sanction Sanction) string {
+	var text string
 
-	case LEAVE_ROOM:
-		leaveMessage := LeaveRoomMessage{Username: user.User.Username}
+	if sanction.Kind != SANCTION_KICK && !sanction.Expires().IsZero() {
+		text += " until " + sanction.Expires().Format(time.RFC822)
+	}
 
-		if room.Room.Name == "" {
-			leaveMessage.Room = "N/A"
-			leaveMessage.Status = FAILURE
-			leaveMessage.Message = TextMessage{Text: "Room doesn't exist"}
-		} else {
-			leaveMessage.Room = room.String()
+	if sanction.Reason != "" {
+		text += ": " + sanction.Reason
+	}
 
-			if err := room.RemoveUser(user); err != nil {
-				server.logger.Error(err)
-				leaveMessage.Status = FAILURE
-				leaveMessage.Message = TextMessage{Text: err.Error()}
-			} else {
-				leaveMessage.Status = SUCCESS
-				leaveMessage.Message = TextMessage{Text: "Successfully left " + room.String()}
-			}
-		}
+	return text
+}
 
-		return BuildMessage(LEAVE_ROOM, leaveMessage), nil
+func (server *ChatServer) checkIsAdmin(user *ServerUser) error {
+	if user.IsAdmin() {
+		return nil
+	}
 
-	case CREATE_ROOM:
-		contents := message.Contents.(CreateRoomMessage)
-		var textMessage TextMessage
+	return NewChatError(PERMISSION_DENIED, "Only administrators can do that")
+}
 
-		if room.Room.Name != "" {
-			textMessage = TextMessage{Username: "SERVER", Room: "SERVER", Text: "Room already exists!"}
-		} else {
-			if _, err := server.roomManager.CreateRoom(contents.Room, contents.Capacity); err != nil {
-				server.logger.Debug("Failed to create room '" + contents.Room + "'")
-				server.logger.Error(err)
-				textMessage = TextMessage{Username: "SERVER", Room: "SERVER", Text: "Failed to create room: " + contents.Room}
-			} else {
-				textMessage = TextMessage{Username: "SERVER", Room: "SERVER", Text: "Successfully created room: " + contents.Room}
-			}
-		}
+// getChangeableMessage finds a message in the room that the user is allowed to edit or delete
+// Authors can change their own messages, the owner, moderators and administrators can change anyone's
+func (server *ChatServer) getChangeableMessage(room *ServerRoom, user *ServerUser, messageId int64) (TextMessage, error) {
+	// Like SEND_MSG only members get a say, which keeps out anyone who's left or been banned, and those muted stay quiet
+	if !room.HasUser(user) {
+		return TextMessage{}, NewChatError(NOT_IN_ROOM, "You need to join "+room.String()+" first")
+	}
 
-		return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
+	if err := server.checkNotSanctioned(room, user, SANCTION_MUTE); err != nil {
+		return TextMessage{}, err
+	}
 
-	case CLOSE_ROOM:
-		contents := message.Contents.(CloseRoomMessage)
-		room, err := server.roomManager.CloseRoom(contents.Room)
-		if err != nil {
-			textMessage := TextMessage{Username: "SERVER", Room: "SERVER", Text: "Failed to close room: " + contents.Room}
-			return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
-		}
+	textMessage, err := server.messageManager.GetRoomMessage(room, messageId)
+	if err != nil {
+		return TextMessage{}, err
+	}
 
-		// Notify all users that the room has been closed
-		for _, user := range room.users {
-			SendRemoteCommand(user.encoder, BuildMessage(RECV_MSG, RecvTextMessage{Message: TextMessage{Username: "SERVER", Room: room.Room.Name, Text: "This room has been closed."}}))
-			SendRemoteCommand(user.encoder, BuildMessage(LEAVE_ROOM, LeaveRoomMessage{Room: room.Room.Name}))
+	if textMessage.Deleted {
+		return TextMessage{}, NewChatError(BAD_REQUEST, "That message has been deleted")
+	}
+
+	if textMessage.Username != user.User.Username {
+		if err := server.checkCanModerate(room, user); err != nil {
+			return TextMessage{}, err
 		}
+	}
 
-		textMessage := TextMessage{Username: "SERVER", Room: "SERVER", Text: "Successfully closed room: " + room.Room.Name}
-		return BuildMessage(RECV_MSG, RecvTextMessage{Message: textMessage}), nil
-	case POP_MSGS:
-		contents := message.Contents.(PopulateMessages)
+	return textMessage, nil
+}
 
-		var timeSince int64
-		timeSince = int64(contents.TimeSince)
+// getNamedUser finds the user a request is about, as opposed to the one making it
+func (server *ChatServer) getNamedUser(username string) (*ServerUser, error) {
+	user, err := server.userManager.GetUser(username)
+	if err != nil {
+		return &ServerUser{}, NewChatError(USER_NOT_FOUND, "There is no user called '"+username+"'")
+	}
 
-		if contents.Limit == 0 {
-			// Default it to something useful
-			contents.Limit = 50
-		}
+	return user, nil
+}
 
-		messages, err := server.messageManager.GetRoomMessagesSince(room, time.Unix(timeSince, 0), contents.Limit)
-		if err != nil {
-			server.logger.Error(err)
-			return Message{}, errors.New("Unable to obtain the rooms messages")
-		}
+// getRoomMember finds the user a role change is about, they have to be in the room
+func (server *ChatServer) getRoomMember(room *ServerRoom, username string) (*ServerUser, error) {
+	member, err := server.getNamedUser(username)
+	if err != nil {
+		return &ServerUser{}, err
+	}
 
-		return BuildMessage(POP_MSGS, PopulateMessages{Messages: messages}), nil
+	if !room.HasUser(member) {
+		return &ServerUser{}, NewChatError(NOT_IN_ROOM, username+" is not in "+room.String())
 	}
 
-	return Message{}, nil
+	return member, nil
 }
 
-func (server *ChatServer) messagePassesTokenTest(message Message) (bool, error) {
+func (server *ChatServer) checkTokenIfRequired(message Message, session *Session) error {
 	// Ensure any Message requiring a Token is valid
 	var token string
 
@@ -316,16 +1780,81 @@ func (server *ChatServer) messagePassesTokenTest(message Message) (bool, error)
 		token = message.Contents.(CloseRoomMessage).Token
 	case POP_MSGS:
 		token = message.Contents.(PopulateMessages).Token
+	case LIST_MEMBERS:
+		token = message.Contents.(ListMembersMessage).Token
+	case SET_TOPIC:
+		token = message.Contents.(SetTopicMessage).Token
+	case SET_DESCRIPTION:
+		token = message.Contents.(SetDescriptionMessage).Token
+	case GRANT_ROLE:
+		token = message.Contents.(GrantRoleMessage).Token
+	case REVOKE_ROLE:
+		token = message.Contents.(RevokeRoleMessage).Token
+	case TRANSFER_OWNER:
+		token = message.Contents.(TransferOwnerMessage).Token
+	case DISCONNECT_USER:
+		token = message.Contents.(DisconnectUserMessage).Token
+	case RESET_PASSWORD:
+		token = message.Contents.(ResetPasswordMessage).Token
+	case DELETE_USER:
+		token = message.Contents.(DeleteUserMessage).Token
+	case SET_ADMIN:
+		token = message.Contents.(SetAdminMessage).Token
+	case KICK:
+		token = message.Contents.(KickMessage).Token
+	case BAN:
+		token = message.Contents.(BanMessage).Token
+	case UNBAN:
+		token = message.Contents.(UnbanMessage).Token
+	case MUTE:
+		token = message.Contents.(MuteMessage).Token
+	case UNMUTE:
+		token = message.Contents.(UnmuteMessage).Token
+	case SET_ACCESS:
+		token = message.Contents.(SetAccessMessage).Token
+	case INVITE:
+		token = message.Contents.(InviteMessage).Token
+	case UNINVITE:
+		token = message.Contents.(UninviteMessage).Token
+	case SEND_DM:
+		token = message.Contents.(SendDirectMessage).Token
+	case POP_DMS:
+		token = message.Contents.(PopulateDirectMessages).Token
+	case LIST_DMS:
+		token = message.Contents.(ListDirectMessagesMessage).Token
+	case UNREAD:
+		token = message.Contents.(UnreadMessage).Token
+	case EDIT_MSG:
+		token = message.Contents.(EditTextMessage).Token
+	case DELETE_MSG:
+		token = message.Contents.(DeleteTextMessage).Token
+	case GET_THREAD:
+		token = message.Contents.(GetThreadMessage).Token
 	default:
-		return true, nil
+		return nil
+	}
+
+	user := session.User()
+	if token == "" || user == nil {
+		return NewChatError(AUTH_REQUIRED, "You need to authenticate first.")
+	}
+
+	valid, err := server.userManager.TokenIsValid(token)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		// Token is provided, but is not valid
+		return NewChatError(AUTH_REQUIRED, "Token is invalid, please authenticate again.")
 	}
 
-	if valid, _ := server.userManager.TokenIsValid(token); valid {
-		return true, nil
+	if token != user.GetToken() {
+		// A valid Token, but someone else's, a connection can only act as the user it authenticated as
+		return NewChatError(AUTH_REQUIRED, "Token does not belong to the user this connection authenticated as.")
 	}
 
-	// Token is provided, but is not valid
-	return false, nil
+	return nil
 }
 
 func (server *ChatServer) getRoomIfRequired(message Message) (*ServerRoom, error) {
@@ -347,13 +1876,47 @@ func (server *ChatServer) getRoomIfRequired(message Message) (*ServerRoom, error
 		name = message.Contents.(CloseRoomMessage).Room
 	case POP_MSGS:
 		name = message.Contents.(PopulateMessages).Room
+	case LIST_MEMBERS:
+		name = message.Contents.(ListMembersMessage).Room
+	case SET_TOPIC:
+		name = message.Contents.(SetTopicMessage).Room
+	case SET_DESCRIPTION:
+		name = message.Contents.(SetDescriptionMessage).Room
+	case GRANT_ROLE:
+		name = message.Contents.(GrantRoleMessage).Room
+	case REVOKE_ROLE:
+		name = message.Contents.(RevokeRoleMessage).Room
+	case TRANSFER_OWNER:
+		name = message.Contents.(TransferOwnerMessage).Room
+	case KICK:
+		name = message.Contents.(KickMessage).Room
+	case BAN:
+		name = message.Contents.(BanMessage).Room
+	case UNBAN:
+		name = message.Contents.(UnbanMessage).Room
+	case MUTE:
+		name = message.Contents.(MuteMessage).Room
+	case UNMUTE:
+		name = message.Contents.(UnmuteMessage).Room
+	case SET_ACCESS:
+		name = message.Contents.(SetAccessMessage).Room
+	case INVITE:
+		name = message.Contents.(InviteMessage).Room
+	case UNINVITE:
+		name = message.Contents.(UninviteMessage).Room
+	case EDIT_MSG:
+		name = message.Contents.(EditTextMessage).Message.Room
+	case DELETE_MSG:
+		name = message.Contents.(DeleteTextMessage).Message.Room
+	case GET_THREAD:
+		name = message.Contents.(GetThreadMessage).Room
 	default:
 		return &ServerRoom{}, nil
 	}
 
 	room, err := server.roomManager.GetRoom(name)
 	if err != nil {
-		if optional && err.Error() == "Room doesn't exist" {
+		if optional && err == ErrRoomDoesNotExist {
 			// If the room doesn't exist and it's optional, return an empty room
 			return &ServerRoom{Room: &Room{}}, nil
 		}
@@ -364,7 +1927,7 @@ func (server *ChatServer) getRoomIfRequired(message Message) (*ServerRoom, error
 	return room, nil
 }
 
-func (server *ChatServer) getUserIfRequired(message Message, encoder *gob.Encoder) (*ServerUser, error) {
+func (server *ChatServer) getUserIfRequired(message Message, session *Session) (*ServerUser, error) {
 	var name string
 
 	switch message.Command {
@@ -374,17 +1937,24 @@ func (server *ChatServer) getUserIfRequired(message Message, encoder *gob.Encode
 		name = message.Contents.(JoinRoomMessage).Username
 	case LEAVE_ROOM:
 		name = message.Contents.(LeaveRoomMessage).Username
+	case CREATE_ROOM, CLOSE_ROOM, SET_TOPIC, SET_DESCRIPTION, GRANT_ROLE, REVOKE_ROLE, TRANSFER_OWNER, LIST_MEMBERS, POP_MSGS,
+		SET_ACCESS, INVITE, UNINVITE, KICK, BAN, UNBAN, MUTE, UNMUTE, DISCONNECT_USER, RESET_PASSWORD, DELETE_USER, SET_ADMIN,
+		SEND_DM, POP_DMS, LIST_DMS, UNREAD, EDIT_MSG, DELETE_MSG, GET_THREAD:
+		// These don't name the user making the request, it can only be the one the connection authenticated as
 	default:
 		return &ServerUser{}, nil
 	}
 
-	user, err := server.userManager.GetUser(name)
-	if err != nil {
-		return &ServerUser{}, err
+	// The user is whoever the connection authenticated as, checkTokenIfRequired has already made sure there is one
+	user := session.User()
+	if user == nil {
+		return &ServerUser{}, NewChatError(AUTH_REQUIRED, "You need to authenticate first.")
 	}
 
-	// Save the encoder so we can send the user messages later
-	user.encoder = encoder
+	// Clients don't have to send a username, but if they do it had better be their own
+	if name != "" && name != user.User.Username {
+		return &ServerUser{}, NewChatError(PERMISSION_DENIED, "You are authenticated as '"+user.User.Username+"' and cannot act as '"+name+"'")
+	}
 
 	return user, nil
 }
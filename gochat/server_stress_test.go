@@ -0,0 +1,391 @@
+package gochat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	STRESS_CLIENTS  = 20
+	STRESS_ROOMS    = 3
+	STRESS_MESSAGES = 10
+)
+
+// startTestServer runs a ChatServer backed by an in-memory SQLite database on a random local port
+func startTestServer(t *testing.T) (*ChatServer, string) {
+	return startTestServerWithDatabase(t, ":memory:")
+}
+
+// startTestServerWithDatabase is startTestServer with the SQLite database kept in a file, so it can outlive the server
+func startTestServerWithDatabase(t *testing.T, database string) (*ChatServer, string) {
+	return startTestServerWithConfig(t, ServerConfig{Database: DatabaseConfig{Product: "sqlite", Database: database}})
+}
+
+// startTestServerWithConfig is startTestServer with the rest of the configuration up to the caller
+func startTestServerWithConfig(t *testing.T, config ServerConfig) (*ChatServer, string) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	server, err := NewChatServer(log.NewEntry(logger), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(socket, JSON_CODEC)
+
+	return server, socket.Addr().String()
+}
+
+// testClient wraps a ChatClient, pushed messages from the server are collected on the pushes channel
+type testClient struct {
+	*ChatClient
+	pushes chan Message
+	exit   chan int
+}
+
+func connectTestClient(address string) (*testClient, error) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	chatClient, _ := NewChatClient(log.NewEntry(logger))
+	if err := chatClient.Connect(address, JSON_CODEC, nil); err != nil {
+		return nil, err
+	}
+
+	client := &testClient{ChatClient: chatClient, pushes: make(chan Message, 1024), exit: make(chan int)}
+	go client.ListenToServer(client.pushes, client.exit)
+
+	return client, nil
+}
+
+// featuresWithout is every feature we support apart from the one given
+func featuresWithout(feature string) []string {
+	features := []string{}
+	for _, supported := range SUPPORTED_FEATURES {
+		if supported != feature {
+			features = append(features, supported)
+		}
+	}
+
+	return features
+}
+
+// connectTestClientWithHello says the given HELLO rather than the client's own, Eg. to act as an older client
+func connectTestClientWithHello(address string, hello HelloMessage) (*testClient, error) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	chatClient, _ := NewChatClient(log.NewEntry(logger))
+	chatClient.connection = connection
+	chatClient.codec, _ = NewCodec(JSON_CODEC, connection)
+
+	if err := SendRemoteCommand(chatClient.codec, BuildMessage(HELLO, hello)); err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	reply := Message{}
+	if err := chatClient.codec.Decode(&reply); err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	if contents := reply.Contents.(HelloMessage); contents.Status != SUCCESS {
+		connection.Close()
+		return nil, errors.New("Server refused our connection: " + contents.Message)
+	}
+
+	chatClient.features = reply.Contents.(HelloMessage).Features
+
+	client := &testClient{ChatClient: chatClient, pushes: make(chan Message, 1024), exit: make(chan int)}
+	go client.ListenToServer(client.pushes, client.exit)
+
+	return client, nil
+}
+
+func (client *testClient) Close() {
+	close(client.exit)
+	client.connection.Close()
+}
+
+// expect sends a request and fails unless the server replies with the given command
+func (client *testClient) expect(message Message, command COMMAND) (Message, error) {
+	reply, err := client.Request(message)
+	if err != nil {
+		return reply, err
+	}
+
+	if reply.Command != command {
+		return reply, fmt.Errorf("Expected a '%s' reply to '%s' but got '%s': %v", command, message.Command, reply.Command, reply.Contents)
+	}
+
+	return reply, nil
+}
+
+// expectError sends a request and fails unless the server replies with an ERROR carrying the given code
+func (client *testClient) expectError(message Message, code ERROR_CODE) error {
+	reply, err := client.expect(message, ERROR)
+	if err != nil {
+		return err
+	}
+
+	if contents := reply.Contents.(ErrorMessage); contents.Code != code {
+		return fmt.Errorf("Expected a '%s' error in reply to '%s' but got '%s': %s", code, message.Command, contents.Code, contents.Message)
+	}
+
+	return nil
+}
+
+// waitForText waits for a RECV_MSG from username with the given text, skipping anything else pushed in the meantime
+func (client *testClient) waitForText(username string, text string) error {
+	timeout := time.After(REPLY_TIMEOUT)
+
+	for {
+		select {
+		case message := <-client.pushes:
+			if contents, ok := message.Contents.(RecvTextMessage); ok {
+				if contents.Message.Username == username && contents.Message.Text == text {
+					return nil
+				}
+			}
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for %s to receive '%s'", username, text)
+		}
+	}
+}
+
+// waitForCommand waits for the server to push a message with the given command, skipping anything else
+func (client *testClient) waitForCommand(command COMMAND) (Message, error) {
+	timeout := time.After(REPLY_TIMEOUT)
+
+	for {
+		select {
+		case message := <-client.pushes:
+			if message.Command == command {
+				return message, nil
+			}
+		case <-timeout:
+			return Message{}, fmt.Errorf("Timed out waiting for a '%s' message", command)
+		}
+	}
+}
+
+// waitForMemberEvent waits for the given event about username, skipping anything else pushed in the meantime
+func (client *testClient) waitForMemberEvent(username string, event string) error {
+	timeout := time.After(REPLY_TIMEOUT)
+
+	for {
+		select {
+		case message := <-client.pushes:
+			if contents, ok := message.Contents.(MemberEventMessage); ok {
+				if contents.Member.Username == username && contents.Event == event {
+					return nil
+				}
+			}
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting to hear %s %s", username, event)
+		}
+	}
+}
+
+// login registers the user and then authenticates as them
+func (client *testClient) login(username string, password string) error {
+	password_hash := sha256.Sum256([]byte(password))
+	password_hash_hex := hex.EncodeToString(password_hash[:])
+
+	if _, err := client.expect(BuildMessage(REGISTER, RegisterMessage{Username: username, PasswordHash: password_hash_hex}), RECV_MSG); err != nil {
+		return err
+	}
+
+	return client.authenticate(username, password)
+}
+
+func (client *testClient) authenticate(username string, password string) error {
+	_, err := client.authenticateForRooms(username, password)
+	return err
+}
+
+// authenticateForRooms authenticates, returning the rooms the server says the user is still a member of
+func (client *testClient) authenticateForRooms(username string, password string) ([]string, error) {
+	password_hash := sha256.Sum256([]byte(password))
+	password_hash_hex := hex.EncodeToString(password_hash[:])
+
+	reply, err := client.expect(BuildMessage(AUTHENTICATE, AuthenticateMessage{Username: username, PasswordHash: password_hash_hex}), TOKEN)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := reply.Contents.(TokenMessage)
+	client.username = username
+	client.token = contents.Token
+	client.admin = contents.Admin
+
+	return contents.Rooms, nil
+}
+
+// chat runs through a full session: log in, create and join a room, talk in it, read the history and leave
+func chat(address string, id int) error {
+	client, err := connectTestClient(address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	username := fmt.Sprintf("user%d", id)
+	if err := client.login(username, "password"); err != nil {
+		return err
+	}
+
+	// Everyone races to create the same few rooms, only one of each can win but the rest must get a clean error back
+	roomName := fmt.Sprintf("room%d", id%STRESS_ROOMS)
+	message, _ := client.BuildCreateRoomMessage(roomName, STRESS_CLIENTS)
+	if _, err := client.Request(message); err != nil {
+		return err
+	}
+
+	message, _ = client.BuildJoinRoomMessage(roomName)
+	if _, err := client.expect(message, JOIN_ROOM); err != nil {
+		return err
+	}
+
+	for i := 0; i < STRESS_MESSAGES; i++ {
+		text := fmt.Sprintf("message %d from %s", i, username)
+
+		message, _ := client.BuildSendMessageMessage(text, roomName)
+		if err := SendRemoteCommand(client.codec, message); err != nil {
+			return err
+		}
+
+		if err := client.waitForText(username, text); err != nil {
+			return err
+		}
+	}
+
+	message, _ = client.BuildPopulateMessage(roomName, time.Unix(0, 0))
+	if _, err := client.expect(message, POP_MSGS); err != nil {
+		return err
+	}
+
+	message, _ = client.BuildListRoomsMessage()
+	reply, err := client.expect(message, LIST_ROOMS)
+	if err != nil {
+		return err
+	}
+
+	if len(reply.Contents.(ListRoomsMessage).RoomInfos) == 0 {
+		return fmt.Errorf("%s was given an empty room list after joining %s", username, roomName)
+	}
+
+	// Half of the clients leave politely, the other half just hang up
+	if id%2 == 0 {
+		message, _ = client.BuildLeaveRoomMessage(roomName)
+		if _, err := client.expect(message, LEAVE_ROOM); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run with -race, the point is to have every manager hit from many connections at once
+func TestServerConcurrentClients(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	var wait sync.WaitGroup
+	errs := make(chan error, STRESS_CLIENTS)
+
+	for i := 0; i < STRESS_CLIENTS; i++ {
+		wait.Add(1)
+
+		go func(id int) {
+			defer wait.Done()
+
+			if err := chat(address, id); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestServerConcurrentReconnects(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	var wait sync.WaitGroup
+	errs := make(chan error, STRESS_CLIENTS)
+
+	for i := 0; i < STRESS_CLIENTS; i++ {
+		wait.Add(1)
+
+		go func(id int) {
+			defer wait.Done()
+
+			// The same user connecting over and over again, dropping the connection while still in a room
+			for attempt := 0; attempt < 5; attempt++ {
+				client, err := connectTestClient(address)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				username := fmt.Sprintf("reconnect%d", id)
+				if attempt == 0 {
+					err = client.login(username, "password")
+				} else {
+					err = client.authenticate(username, "password")
+				}
+
+				if err == nil {
+					message, _ := client.BuildCreateRoomMessage("reconnect", STRESS_CLIENTS)
+					_, err = client.Request(message)
+				}
+
+				if err == nil {
+					message, _ := client.BuildJoinRoomMessage("reconnect")
+					_, err = client.expect(message, JOIN_ROOM)
+				}
+
+				client.Close()
+
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
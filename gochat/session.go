@@ -0,0 +1,59 @@
+package gochat
+
+import (
+	"sync"
+)
+
+// Session is a single client connection, a user logged in from several places has a Session for each of them
+// It's an Encoder, anything sent to it is queued for that one connection
+type Session struct {
+	connection Connection
+	outbound   *OutboundQueue
+	version    int
+	features   []string
+	lock       sync.Mutex
+	user       *ServerUser
+}
+
+// NewSession takes the protocol version and features negotiated in the connection's HELLO
+func NewSession(connection Connection, outbound *OutboundQueue, version int, features []string) *Session {
+	return &Session{connection: connection, outbound: outbound, version: version, features: features}
+}
+
+// Version is the protocol version the client said HELLO with
+func (session *Session) Version() int {
+	return session.version
+}
+
+func (session *Session) HasFeature(feature string) bool {
+	return hasFeature(session.features, feature)
+}
+
+func (session *Session) Encode(message Message) error {
+	return session.outbound.Encode(message)
+}
+
+// User returns who the session is acting as, or nil if it hasn't said yet
+func (session *Session) User() *ServerUser {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	return session.user
+}
+
+// setUser attaches the session to the user, returning the user it was previously attached to (if any)
+func (session *Session) setUser(user *ServerUser) *ServerUser {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	previous := session.user
+	session.user = user
+
+	return previous
+}
+
+// Close stops the session's outbound queue and drops the connection
+func (session *Session) Close() {
+	session.outbound.Close()
+	session.connection.Close()
+}
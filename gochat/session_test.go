@@ -0,0 +1,359 @@
+package gochat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUserWithSeveralSessions(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	laptop, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer laptop.Close()
+
+	if err := laptop.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	desktop, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := desktop.authenticate("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := laptop.BuildCreateRoomMessage("lobby", 10)
+	if _, err := laptop.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	// Joining from both sessions leaves alice in the room once
+	for _, client := range []*testClient{laptop, desktop} {
+		message, _ := client.BuildJoinRoomMessage("lobby")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	room, _ := server.roomManager.GetRoom("lobby")
+	if users := room.Users(); len(users) != 1 {
+		t.Fatalf("Expected alice to be in the room once, found %d users", len(users))
+	}
+
+	// Whichever session sends, every session sees it
+	message, _ = laptop.BuildSendMessageMessage("hello from the laptop", "lobby")
+	if err := SendRemoteCommand(laptop.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{laptop, desktop} {
+		if err := client.waitForText("alice", "hello from the laptop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dropping one session leaves alice in the room on the other
+	desktop.Close()
+
+	alice, _ := server.userManager.GetUser("alice")
+	for deadline := time.Now().Add(REPLY_TIMEOUT); len(alice.Sessions()) > 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the server to notice the desktop session dropped")
+		}
+	}
+
+	if !room.HasUser(alice) {
+		t.Fatal("Expected alice to still be in the room after one of her sessions dropped")
+	}
+
+	message, _ = laptop.BuildSendMessageMessage("still here", "lobby")
+	if err := SendRemoteCommand(laptop.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := laptop.waitForText("alice", "still here"); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestSessionCannotActAsAnotherUser(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	mallory, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mallory.login("mallory", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := alice.BuildCreateRoomMessage("lobby", 10)
+	if _, err := alice.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{alice, mallory} {
+		message, _ := client.BuildJoinRoomMessage("lobby")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Naming someone else is refused outright
+	message = BuildMessage(SEND_MSG, SendTextMessage{Token: mallory.token, Message: TextMessage{Username: "alice", Room: "lobby", Text: "I am alice"}})
+	reply, err := mallory.expect(message, ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := reply.Contents.(ErrorMessage).Code; code != PERMISSION_DENIED {
+		t.Fatalf("Expected %s when sending as someone else, got %s", PERMISSION_DENIED, code)
+	}
+
+	// So is borrowing their token
+	message = BuildMessage(SEND_MSG, SendTextMessage{Token: alice.token, Message: TextMessage{Room: "lobby", Text: "I am alice"}})
+	reply, err = mallory.expect(message, ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := reply.Contents.(ErrorMessage).Code; code != AUTH_REQUIRED {
+		t.Fatalf("Expected %s when using someone else's token, got %s", AUTH_REQUIRED, code)
+	}
+
+	// Leaving the username out is fine, the server fills it in
+	message = BuildMessage(SEND_MSG, SendTextMessage{Token: mallory.token, Message: TextMessage{Room: "lobby", Text: "hello"}})
+	if err := SendRemoteCommand(mallory.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.waitForText("mallory", "hello"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredTokenIsRenewed(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	client, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wind the token back past its lifetime
+	alice, _ := server.userManager.GetUser("alice")
+	alice.lock.Lock()
+	alice.tokenExpiry = time.Now().Add(-25 * time.Hour)
+	alice.lock.Unlock()
+
+	message, _ := client.BuildCreateRoomMessage("lobby", 10)
+	if err := client.expectError(message, TOKEN_EXPIRED); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := client.token
+	if err := client.authenticate("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.token == expired {
+		t.Fatal("Expected authenticating again to hand out a new token")
+	}
+
+	message, _ = client.BuildCreateRoomMessage("lobby", 10)
+	if _, err := client.expect(message, RECV_MSG); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old one is gone for good
+	message = BuildMessage(CREATE_ROOM, CreateRoomMessage{Room: "lounge", Capacity: 10, Token: expired})
+	if err := client.expectError(message, AUTH_REQUIRED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeoutWithoutHeartbeat(t *testing.T) {
+	server, address := startTestServerWithConfig(t, ServerConfig{
+		Database:   DatabaseConfig{Product: "sqlite", Database: ":memory:"},
+		Connection: ConnectionConfig{IdleTimeout: 500 * time.Millisecond},
+	})
+	defer server.Shutdown()
+
+	// Without the heartbeat feature there's no read deadline other than the idle one
+	client, err := connectTestClientWithHello(address, HelloMessage{Version: PROTOCOL_VERSION, Features: featuresWithout(FEATURE_HEARTBEAT)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := client.expect(BuildMessage(LIST_ROOMS, ListRoomsMessage{}), LIST_ROOMS); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the first deadline but not the one the LIST_ROOMS put off
+	time.Sleep(300 * time.Millisecond)
+
+	select {
+	case <-client.Disconnected():
+		t.Fatal("Expected the LIST_ROOMS to count as activity")
+	default:
+	}
+
+	select {
+	case <-client.Disconnected():
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Expected the idle client to be disconnected")
+	}
+}
+
+func TestRepliesWithoutFeatures(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	// A client from before request IDs, ERRORs and the shutdown notice
+	client, err := connectTestClientWithHello(address, HelloMessage{Version: PROTOCOL_VERSION, Features: []string{FEATURE_HEARTBEAT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	message := BuildMessage(JOIN_ROOM, JoinRoomMessage{Room: "lobby"})
+	message.RequestId = 7
+	if err := SendRemoteCommand(client.codec, message); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := client.waitForCommand(RECV_MSG)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.RequestId != 0 || reply.Contents.(RecvTextMessage).Message.Username != "SERVER" {
+		t.Fatalf("Expected the error as text from SERVER without a RequestId, got %+v", reply)
+	}
+
+	server.Shutdown()
+
+	if err := client.waitForText("SERVER", "The server is shutting down."); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRequestsGetTheirOwnReplies(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	alice, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := connectTestClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	if err := alice.login("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.login("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	const ROOMS = 10
+
+	rooms := []string{"lobby"}
+	for i := 0; i < ROOMS; i++ {
+		rooms = append(rooms, fmt.Sprintf("room%d", i))
+	}
+
+	for _, room := range rooms {
+		message, _ := alice.BuildCreateRoomMessage(room, 10)
+		if _, err := alice.expect(message, RECV_MSG); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		message, _ := client.BuildJoinRoomMessage("lobby")
+		if _, err := client.expect(message, JOIN_ROOM); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob keeps talking in the lobby while alice has a request in flight for every other room
+	talking := make(chan error, 1)
+	go func() {
+		for i := 0; i < ROOMS; i++ {
+			message, _ := bob.BuildSendMessageMessage(fmt.Sprintf("push %d", i), "lobby")
+			if err := SendRemoteCommand(bob.codec, message); err != nil {
+				talking <- err
+				return
+			}
+		}
+
+		talking <- nil
+	}()
+
+	errs := make(chan error, ROOMS)
+	for _, room := range rooms[1:] {
+		go func(room string) {
+			message, _ := alice.BuildJoinRoomMessage(room)
+			reply, err := alice.expect(message, JOIN_ROOM)
+			if err == nil && reply.Contents.(JoinRoomMessage).Room != room {
+				err = fmt.Errorf("Expected the reply to joining %s but got %+v", room, reply.Contents)
+			}
+
+			errs <- err
+		}(room)
+	}
+
+	for i := 0; i < ROOMS; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-talking; err != nil {
+		t.Fatal(err)
+	}
+
+	// Every reply went to its own request, otherwise one would have timed out, and bob's messages still went to the push channel in order
+	for i := 0; i < ROOMS; i++ {
+		if _, err := alice.waitForRoomMessage("bob", fmt.Sprintf("push %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
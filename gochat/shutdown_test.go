@@ -0,0 +1,90 @@
+package gochat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownFinishesRequestsAndNotifiesClients(t *testing.T) {
+	server, address := startTestServer(t)
+
+	// Talk to the server directly so we see exactly what it sends and in what order
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		server.Shutdown()
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	connection.SetReadDeadline(time.Now().Add(REPLY_TIMEOUT))
+	codec, _ := NewCodec(JSON_CODEC, connection)
+
+	hello := Message{}
+	if err := SendRemoteCommand(codec, BuildHelloMessage()); err != nil {
+		server.Shutdown()
+		t.Fatal(err)
+	}
+
+	if err := codec.Decode(&hello); err != nil {
+		server.Shutdown()
+		t.Fatal(err)
+	}
+
+	// Holding the room manager's lock keeps a LIST_ROOMS in flight until we let go of it
+	server.roomManager.lock.Lock()
+
+	request := BuildMessage(LIST_ROOMS, ListRoomsMessage{})
+	request.RequestId = 1
+	if err := SendRemoteCommand(codec, request); err != nil {
+		server.roomManager.lock.Unlock()
+		server.Shutdown()
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	server.roomManager.lock.Unlock()
+
+	// Shutdown waits for the request to be answered before sending the notice and hanging up
+	reply := Message{}
+	if err := codec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Command != LIST_ROOMS || reply.RequestId != 1 {
+		t.Fatalf("Expected the in flight LIST_ROOMS to be answered first, got %+v", reply)
+	}
+
+	notice := Message{}
+	if err := codec.Decode(&notice); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice.Command != SERVER_SHUTDOWN || notice.Contents.(ServerShutdownMessage).Message != "The server is shutting down." {
+		t.Fatalf("Expected the shutdown notice, got %+v", notice)
+	}
+
+	if err := codec.Decode(&Message{}); err == nil {
+		t.Fatal("Expected the connection to be closed after the notice")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("Timed out waiting for the connection to be closed")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(REPLY_TIMEOUT):
+		t.Fatal("Timed out waiting for Shutdown to return")
+	}
+
+	// Nobody new gets in
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Fatal("Expected new connections to be refused after shutdown")
+	}
+}
@@ -3,6 +3,7 @@ package gochat
 import (
 	"errors"
 	"fmt"
+	"strconv"
 
 	"database/sql/driver"
 	log "github.com/Sirupsen/logrus"
@@ -24,6 +25,11 @@ func NewStorageManager(config DatabaseConfig, logger *log.Entry) (*StorageManage
 	switch config.Product {
 	case "sqlite":
 		db, err = sqlx.Open("sqlite3", config.Database)
+		if err == nil {
+			// SQLite only allows a single writer, funnel every goroutine through one connection rather than hit SQLITE_BUSY
+			// This also keeps ":memory:" databases working, as each new connection would get its own empty database
+			db.SetMaxOpenConns(1)
+		}
 	case "postgresql":
 		connection_string := fmt.Sprint(
 			"dbname="+config.Database,
@@ -71,7 +77,7 @@ func (manager *StorageManager) CheckExecOutcome(result driver.Result, err error,
 	}
 
 	if !affectedCheck(affected) {
-		return errors.New("We affected a different number of rows than we were expecting (" + string(affected) + ")")
+		return errors.New("We affected a different number of rows than we were expecting (" + strconv.FormatInt(affected, 10) + ")")
 	}
 
 	return nil
@@ -88,3 +94,17 @@ func (manager *StorageManager) ExecOneRow(result driver.Result, err error) error
 func (manager *StorageManager) ExecAtLeastOneRow(result driver.Result, err error) error {
 	return manager.CheckExecOutcome(result, err, func(affected int64) bool { return affected > 0 })
 }
+
+// AddColumnIfMissing brings a table created by an older version up to date, definition is everything after the column name
+// Eg. AddColumnIfMissing("rooms", "owner_id", "INTEGER DEFAULT 0")
+func (manager *StorageManager) AddColumnIfMissing(table string, column string, definition string) error {
+	// Selecting a column that doesn't exist fails on every DB we support
+	rows, err := manager.db.Query("SELECT " + column + " FROM " + table + " LIMIT 1")
+	if err == nil {
+		return rows.Close()
+	}
+
+	manager.logger.Info("Adding the " + column + " column to the " + table + " table")
+	_, err = manager.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,95 @@
+package gochat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSConfig enables TLS on every server listener, setting ClientCA also requires clients to present a certificate signed by it
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+func (config TLSConfig) Enabled() bool {
+	return config.Cert != "" || config.Key != "" || config.ClientCA != ""
+}
+
+func LoadServerTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if config.Cert == "" || config.Key == "" {
+		return nil, errors.New("Both a TLS cert and key are required to enable TLS")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCA != "" {
+		pool, err := loadCertPool(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		// Mutual TLS, only clients with a certificate signed by our CA get in
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadClientTLSConfig builds the client side TLS settings, every argument is optional
+// caFile replaces the system roots, certFile/keyFile present a client certificate for mutual TLS
+func LoadClientTLSConfig(caFile string, certFile string, keyFile string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("Both a client cert and key are required for mutual TLS")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates could be parsed from " + filename)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,249 @@
+package gochat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// testCertificate is a certificate issued by issueTestCertificate, along with where it was written
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+// issueTestCertificate signs the template with the parent (or itself if there isn't one), writing <name>.pem and <name>-key.pem into dir
+func issueTestCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certFile:    filepath.Join(dir, name+".pem"),
+		keyFile:     filepath.Join(dir, name+"-key.pem"),
+	}
+
+	if err := ioutil.WriteFile(issued.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(issued.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return issued
+}
+
+func issueTestCA(t *testing.T, dir string, name string) *testCertificate {
+	return issueTestCertificate(t, dir, name, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+// startTestTLSServer is startTestServer listening with TLS, the same way Listen does
+func startTestTLSServer(t *testing.T, config TLSConfig) (*ChatServer, string) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	server, err := NewChatServer(log.NewEntry(logger), ServerConfig{Database: DatabaseConfig{Product: "sqlite", Database: ":memory:"}, TLS: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket, err := tls.Listen("tcp", "127.0.0.1:0", server.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(socket, JSON_CODEC)
+
+	return server, socket.Addr().String()
+}
+
+// connectTestTLSClient connects through ChatClient.Connect with the same TLS settings the client's flags build
+func connectTestTLSClient(address string, caFile string, certFile string, keyFile string, insecure bool) (*testClient, error) {
+	tlsConfig, err := LoadClientTLSConfig(caFile, certFile, keyFile, insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	chatClient, _ := NewChatClient(log.NewEntry(logger))
+	if err := chatClient.Connect(address, JSON_CODEC, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	client := &testClient{ChatClient: chatClient, pushes: make(chan Message, 1024), exit: make(chan int)}
+	go client.ListenToServer(client.pushes, client.exit)
+
+	return client, nil
+}
+
+func TestTLSConnections(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := issueTestCA(t, dir, "ca")
+	serverCert := issueTestCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientCert := issueTestCertificate(t, dir, "client", &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	// A client certificate from a CA the server has never heard of
+	otherCA := issueTestCA(t, dir, "other-ca")
+	strangerCert := issueTestCertificate(t, dir, "stranger", &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, otherCA)
+
+	t.Run("server only", func(t *testing.T) {
+		server, address := startTestTLSServer(t, TLSConfig{Cert: serverCert.certFile, Key: serverCert.keyFile})
+		defer server.Shutdown()
+
+		client, err := connectTestTLSClient(address, ca.certFile, "", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login("alice", "hunter2"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Without -ca the system roots don't know our CA, so the server's certificate is refused
+		if client, err := connectTestTLSClient(address, "", "", "", false); err == nil {
+			client.Close()
+			t.Fatal("Expected a server certificate from an unknown CA to be refused")
+		}
+
+		// Unless -insecure says not to check it
+		insecure, err := connectTestTLSClient(address, "", "", "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer insecure.Close()
+
+		if err := insecure.login("bob", "hunter2"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Plain TCP clients don't get a HELLO out of a TLS listener
+		if client, err := connectTestClient(address); err == nil {
+			client.Close()
+			t.Fatal("Expected a client without TLS to be refused")
+		}
+	})
+
+	t.Run("client certificates", func(t *testing.T) {
+		server, address := startTestTLSServer(t, TLSConfig{Cert: serverCert.certFile, Key: serverCert.keyFile, ClientCA: ca.certFile})
+		defer server.Shutdown()
+
+		client, err := connectTestTLSClient(address, ca.certFile, clientCert.certFile, clientCert.keyFile, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.login("alice", "hunter2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if client, err := connectTestTLSClient(address, ca.certFile, "", "", false); err == nil {
+			client.Close()
+			t.Fatal("Expected a client without a certificate to be refused")
+		}
+
+		if client, err := connectTestTLSClient(address, ca.certFile, strangerCert.certFile, strangerCert.keyFile, false); err == nil {
+			client.Close()
+			t.Fatal("Expected a client certificate from an unknown CA to be refused")
+		}
+
+		// -insecure only skips checking the server, the client still has to prove who it is
+		if client, err := connectTestTLSClient(address, "", "", "", true); err == nil {
+			client.Close()
+			t.Fatal("Expected -insecure without a certificate to be refused")
+		}
+
+		insecure, err := connectTestTLSClient(address, "", clientCert.certFile, clientCert.keyFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer insecure.Close()
+
+		if err := insecure.login("bob", "hunter2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := issueTestCA(t, dir, "ca")
+
+	if _, err := LoadServerTLSConfig(TLSConfig{Cert: ca.certFile}); err == nil {
+		t.Fatal("Expected a cert without a key to be refused")
+	}
+
+	if _, err := LoadServerTLSConfig(TLSConfig{Cert: ca.certFile, Key: ca.keyFile, ClientCA: ca.keyFile}); err == nil {
+		t.Fatal("Expected a client CA file without certificates in it to be refused")
+	}
+
+	if _, err := LoadClientTLSConfig("", ca.certFile, "", false); err == nil {
+		t.Fatal("Expected a client cert without a key to be refused")
+	}
+
+	if _, err := LoadClientTLSConfig(filepath.Join(dir, "missing.pem"), "", "", false); err == nil {
+		t.Fatal("Expected a missing CA file to be refused")
+	}
+}
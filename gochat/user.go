@@ -1,9 +1,9 @@
 package gochat
 
 import (
-	"encoding/gob"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -18,13 +18,15 @@ type User struct {
 	Salt            string `db:"salt"`
 	Password_sha256 string `db:"password_sha256"`
 	Deleted         bool   `db:"deleted"`
+	Admin           bool   `db:"admin"`
 }
 
 type ServerUser struct {
 	User        *User
+	lock        sync.Mutex
 	token       string
 	tokenExpiry time.Time
-	encoder     *gob.Encoder
+	sessions    []*Session
 }
 
 func (user *ServerUser) String() string {
@@ -32,6 +34,9 @@ func (user *ServerUser) String() string {
 }
 
 func (user *ServerUser) GetToken() string {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
 	if user.token == "" {
 		user.generateToken()
 	}
@@ -39,6 +44,133 @@ func (user *ServerUser) GetToken() string {
 	return user.token
 }
 
+// IsAdmin reports whether the user is a server wide administrator
+func (user *ServerUser) IsAdmin() bool {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	return user.User.Admin
+}
+
+func (user *ServerUser) setAdmin(admin bool) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	user.User.Admin = admin
+}
+
+// password returns the user's salt and salted password hash
+func (user *ServerUser) password() (string, string) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	return user.User.Salt, user.User.Password_sha256
+}
+
+func (user *ServerUser) setPassword(salt string, password_sha256 string) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	user.User.Salt = salt
+	user.User.Password_sha256 = password_sha256
+}
+
+// tokenIsFresh reports whether the token is still within its 24 hour lifetime
+func (user *ServerUser) tokenIsFresh() bool {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	return user.tokenExpiry.After(time.Now().Add(time.Hour * -24))
+}
+
+// renewToken replaces the token with a new one, returning the old and new tokens
+func (user *ServerUser) renewToken() (string, string) {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	old := user.token
+	user.generateToken()
+
+	return old, user.token
+}
+
+// AddSession connects the user to another session, returning true if the user was offline until now
+// Adding the same session twice does nothing
+func (user *ServerUser) AddSession(session *Session) bool {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	for _, existing := range user.sessions {
+		if existing == session {
+			return false
+		}
+	}
+
+	user.sessions = append(user.sessions, session)
+	return len(user.sessions) == 1
+}
+
+// Online reports whether the user is connected through any session
+func (user *ServerUser) Online() bool {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	return len(user.sessions) > 0
+}
+
+// RemoveSession disconnects the session from the user, returning how many sessions the user still has
+func (user *ServerUser) RemoveSession(session *Session) int {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	for i, existing := range user.sessions {
+		if existing == session {
+			user.sessions = append(user.sessions[:i], user.sessions[i+1:]...)
+			break
+		}
+	}
+
+	return len(user.sessions)
+}
+
+// Sessions returns a snapshot of every session the user is connected through
+func (user *ServerUser) Sessions() []*Session {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	sessions := make([]*Session, len(user.sessions))
+	copy(sessions, user.sessions)
+
+	return sessions
+}
+
+// Send queues the message on every one of the user's sessions
+func (user *ServerUser) Send(message Message) {
+	for _, session := range user.Sessions() {
+		SendRemoteCommand(session, message)
+	}
+}
+
+// SendWithFallback queues the message on the sessions that negotiated the feature, and the fallback on the rest
+// It returns true if any of the sessions took it
+func (user *ServerUser) SendWithFallback(feature string, message Message, fallback Message) bool {
+	sent := false
+	for _, session := range user.Sessions() {
+		var err error
+		if session.HasFeature(feature) {
+			err = SendRemoteCommand(session, message)
+		} else {
+			err = SendRemoteCommand(session, fallback)
+		}
+
+		if err == nil {
+			sent = true
+		}
+	}
+
+	return sent
+}
+
 func (user *ServerUser) generateToken() {
 	// Seed the RNG
 	rand.Seed(time.Now().UnixNano())
@@ -6,7 +6,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
-	"time"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -19,20 +19,29 @@ const (
 	CREATE_USER_SQL     = "INSERT INTO users (username, salt, password_sha256, Deleted) VALUES (?, ?, ?, ?)"
 	UPDATE_PASSWORD_SQL = "UPDATE users SET salt=?, password_sha256=? WHERE username=?"
 	DELETE_USER_SQL     = "UPDATE users SET deleted=true WHERE username=?"
+	SET_ADMIN_SQL       = "UPDATE users SET admin=? WHERE username=?"
 	GET_USER_SQL        = "SELECT * FROM users WHERE username=? AND deleted=?"
+	USER_EXISTS_SQL     = "SELECT COUNT(*) FROM users WHERE username=?"
 	USER_SCHEMA         = `
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		username TEXT UNIQUE,
 		salt TEXT,
 		password_sha256	TEXT,
-		deleted BOOLEAN
+		deleted BOOLEAN,
+		admin BOOLEAN DEFAULT false
 	)`
 )
 
+var (
+	ErrUsernameTaken = NewChatError(USERNAME_TAKEN, "That username is already taken!")
+	ErrTokenExpired  = NewChatError(TOKEN_EXPIRED, "Your token has expired, please authenticate again.")
+)
+
 type UserManager struct {
 	storage     *StorageManager
 	logger      *log.Entry
+	lock        sync.RWMutex
 	user_cache  map[string]*ServerUser
 	token_cache map[string]*ServerUser
 }
@@ -44,6 +53,11 @@ func NewUserManager(storage *StorageManager, logger *log.Entry) (*UserManager, e
 		return &UserManager{}, err
 	}
 
+	// Administrators came after the users table was first released
+	if err := storage.AddColumnIfMissing("users", "admin", "BOOLEAN DEFAULT false"); err != nil {
+		return &UserManager{}, err
+	}
+
 	manager := UserManager{
 		storage:     storage,
 		logger:      logger,
@@ -56,7 +70,11 @@ func NewUserManager(storage *StorageManager, logger *log.Entry) (*UserManager, e
 
 func (manager *UserManager) GetUser(username string) (*ServerUser, error) {
 	// If the user has already been extracted from storage, just return them
-	if user, ok := manager.user_cache[username]; ok {
+	manager.lock.RLock()
+	user, ok := manager.user_cache[username]
+	manager.lock.RUnlock()
+
+	if ok {
 		return user, nil
 	}
 
@@ -70,14 +88,22 @@ func (manager *UserManager) GetUser(username string) (*ServerUser, error) {
 		return &ServerUser{}, err
 	}
 
-	user := ServerUser{User: &dbUser}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	// Someone else may have loaded them while we were talking to the DB, everyone must share the one ServerUser
+	if user, ok := manager.user_cache[username]; ok {
+		return user, nil
+	}
+
+	user = &ServerUser{User: &dbUser}
 
 	// Put the user in the cache
-	manager.user_cache[dbUser.Username] = &user
+	manager.user_cache[dbUser.Username] = user
 
 	// Generate a token for the user and put it in the token cache
-	manager.token_cache[user.GetToken()] = &user
-	return &user, nil
+	manager.token_cache[user.GetToken()] = user
+	return user, nil
 }
 
 func hashPassword(password string) (string, string, error) {
@@ -94,6 +120,16 @@ func hashPassword(password string) (string, string, error) {
 }
 
 func (manager *UserManager) CreateUser(username string, password string) error {
+	// Usernames stay taken even after the user is deleted
+	var count int
+	if err := manager.storage.db.Get(&count, manager.storage.db.Rebind(USER_EXISTS_SQL), username); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrUsernameTaken
+	}
+
 	// Hash the password, generating a new salt as well
 	salt, salted_hash, err := hashPassword(password)
 	if err != nil {
@@ -109,42 +145,86 @@ func (manager *UserManager) AuthenticateUser(username string, password_sha256 st
 	user, err := manager.GetUser(username)
 	if err != nil {
 		manager.logger.Error(err)
-		return &ServerUser{}, errors.New("That user does not exist!")
+		return &ServerUser{}, NewChatError(INVALID_CREDENTIALS, "That user does not exist!")
 	}
 
-	server_salt, err := hex.DecodeString(user.User.Salt)
+	salt, server_hash_string := user.password()
+
+	matches, err := passwordMatches(salt, server_hash_string, password_sha256)
 	if err != nil {
 		return &ServerUser{}, errors.New("Error decoding users server salt.")
 	}
 
-	client_hash_bytes := sha256.Sum256(append(server_salt, []byte(password_sha256)...))
-	client_hash_string := hex.EncodeToString(client_hash_bytes[:])
+	if matches {
+		// An expired token would only be turned away again, so hand out a new one
+		if !user.tokenIsFresh() {
+			manager.renewToken(user)
+		}
 
-	if client_hash_string == user.User.Password_sha256 {
 		return user, nil
 	} else {
-		return &ServerUser{}, errors.New("Invalid password!")
+		return &ServerUser{}, NewChatError(INVALID_CREDENTIALS, "Invalid password!")
 	}
 }
 
+// passwordMatches checks a password from a client against the salted hash hashPassword gave us for it
+func passwordMatches(salt string, salted_hash string, password_sha256 string) (bool, error) {
+	server_salt, err := hex.DecodeString(salt)
+	if err != nil {
+		return false, err
+	}
+
+	client_hash_bytes := sha256.Sum256(append(server_salt, []byte(password_sha256)...))
+	client_hash_string := hex.EncodeToString(client_hash_bytes[:])
+
+	return client_hash_string == salted_hash, nil
+}
+
 func (manager *UserManager) TokenIsValid(token string) (bool, error) {
 	// We can safely assert here that if the Token does not belong to a user in the cache, then the Token is invalid
-	for _, user := range manager.user_cache {
-		if user.token == token {
-			if user.tokenExpiry.After(time.Now().Add(time.Hour * -24)) {
-				// Token is valid and Token has not expired yet, this is a valid request
-				return true, nil
-			} else {
-				return false, nil
-			}
-		}
+	manager.lock.RLock()
+	user, ok := manager.token_cache[token]
+	manager.lock.RUnlock()
+
+	if !ok {
+		// ServerUser was not found or their Token doesn't exist
+		return false, nil
+	}
+
+	if !user.tokenIsFresh() {
+		return false, ErrTokenExpired
 	}
 
-	// ServerUser was not found or their Token doesn't exist
-	return false, nil
+	// Token is valid and Token has not expired yet, this is a valid request
+	return true, nil
+}
+
+// renewToken gives the user a new token, dropping the old one from the token cache so it stops working
+func (manager *UserManager) renewToken(user *ServerUser) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	old, token := user.renewToken()
+	delete(manager.token_cache, old)
+	manager.token_cache[token] = user
+}
+
+func (manager *UserManager) evictUser(username string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if user, ok := manager.user_cache[username]; ok {
+		delete(manager.token_cache, user.GetToken())
+		delete(manager.user_cache, username)
+	}
 }
 
 func (manager *UserManager) UpdatePassword(username string, password string) error {
+	user, err := manager.GetUser(username)
+	if err != nil {
+		return err
+	}
+
 	// Hash the password, generating a new salt as well
 	salt, password, err := hashPassword(password)
 	if err != nil {
@@ -157,24 +237,33 @@ func (manager *UserManager) UpdatePassword(username string, password string) err
 		return err
 	}
 
-	// Delete them from the cache
-	delete(manager.user_cache, username)
+	// Update the cached user rather than evicting them, their rooms and sessions still point at it
+	user.setPassword(salt, password)
+
+	// Whoever had the old password mustn't carry on with the token it got them
+	manager.renewToken(user)
+	return nil
+}
 
-	// Fetch the updated user
+// SetAdmin makes the user a server wide administrator, or takes it away from them
+func (manager *UserManager) SetAdmin(username string, admin bool) error {
 	user, err := manager.GetUser(username)
 	if err != nil {
 		return err
 	}
 
-	// Add them back into the cache
-	manager.user_cache[user.User.Username] = user
+	sql := manager.storage.db.Rebind(SET_ADMIN_SQL)
+	if err := manager.storage.ExecOneRow(manager.storage.db.Exec(sql, admin, username)); err != nil {
+		return err
+	}
 
+	user.setAdmin(admin)
 	return nil
 }
 
 func (manager *UserManager) DeleteUser(username string) error {
 	// Remove the user from the cache
-	delete(manager.user_cache, username)
+	manager.evictUser(username)
 
 	// Mark the user as deleted
 	sql := manager.storage.db.Rebind(DELETE_USER_SQL)
@@ -0,0 +1,114 @@
+package gochat
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketConfig enables an HTTP listener that upgrades to WebSocket, each frame carries one JSON encoded Message
+type WebSocketConfig struct {
+	Address        string   `yaml:"address"`
+	Path           string   `yaml:"path"`
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// WebSocketCodec speaks the same JSON envelopes as JSONCodec but uses WebSocket text frames instead of newlines
+type WebSocketCodec struct {
+	lock       sync.Mutex
+	connection *websocket.Conn
+}
+
+func NewWebSocketCodec(connection *websocket.Conn) *WebSocketCodec {
+	return &WebSocketCodec{connection: connection}
+}
+
+func (codec *WebSocketCodec) Encode(message Message) error {
+	frame, err := encodeJSONMessage(message)
+	if err != nil {
+		return err
+	}
+
+	codec.lock.Lock()
+	defer codec.lock.Unlock()
+
+	return codec.connection.WriteMessage(websocket.TextMessage, frame)
+}
+
+func (codec *WebSocketCodec) Decode(message *Message) error {
+	_, frame, err := codec.connection.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	return decodeJSONMessage(frame, message)
+}
+
+func (server *ChatServer) ListenWebSocket(config WebSocketConfig) error {
+	path := config.Path
+	if path == "" {
+		path = "/"
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: buildOriginCheck(config.AllowedOrigins)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
+		connection, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			// The upgrader has already replied to the client with an HTTP error
+			server.logger.Error(err)
+			return
+		}
+
+		// Frames are held in memory whole, so cap them the same as the JSON codec's lines
+		connection.SetReadLimit(MAX_JSON_LINE)
+
+		server.logger.Info("Accepted incoming WebSocket connection from " + request.RemoteAddr)
+		server.HandleIncomingConnection(connection, NewWebSocketCodec(connection))
+	})
+
+	httpServer := &http.Server{Addr: config.Address, Handler: mux, TLSConfig: server.tlsConfig}
+	if !server.trackListener(httpServer) {
+		return nil
+	}
+
+	var err error
+
+	if server.tlsConfig != nil {
+		server.logger.Info("Listening on " + config.Address + path + " (websocket, TLS)")
+
+		// The certificates are already loaded into the TLSConfig
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		server.logger.Info("Listening on " + config.Address + path + " (websocket)")
+		err = httpServer.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		// Shutdown closed the listener on us
+		return nil
+	}
+
+	return err
+}
+
+func buildOriginCheck(allowedOrigins []string) func(*http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		// Fall back to the upgrader's default same-origin check
+		return nil
+	}
+
+	return func(request *http.Request) bool {
+		origin := request.Header.Get("Origin")
+
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || allowed == origin {
+				return true
+			}
+		}
+
+		return false
+	}
+}
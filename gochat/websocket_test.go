@@ -0,0 +1,120 @@
+package gochat
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTestWebSocket starts the server's WebSocket gateway on a free local port, returning its URL
+func startTestWebSocket(t *testing.T, server *ChatServer, allowedOrigins []string) string {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := socket.Addr().String()
+	socket.Close()
+
+	go server.ListenWebSocket(WebSocketConfig{Address: address, Path: "/chat", AllowedOrigins: allowedOrigins})
+
+	// Wait for it to start listening
+	for deadline := time.Now().Add(REPLY_TIMEOUT); ; time.Sleep(10 * time.Millisecond) {
+		if connection, err := net.Dial("tcp", address); err == nil {
+			connection.Close()
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the WebSocket gateway to start")
+		}
+	}
+
+	return "ws://" + address + "/chat"
+}
+
+func TestWebSocketGateway(t *testing.T) {
+	server, _ := startTestServer(t)
+	defer server.Shutdown()
+
+	url := startTestWebSocket(t, server, []string{"https://chat.example.com"})
+
+	// Origins that aren't allowed are turned away before the upgrade
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil {
+		t.Fatal("Expected a connection from an origin that isn't allowed to be refused")
+	}
+
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a %d response to the refused origin but got %v", http.StatusForbidden, response)
+	}
+
+	connection, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://chat.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	connection.SetReadDeadline(time.Now().Add(REPLY_TIMEOUT))
+	codec := NewWebSocketCodec(connection)
+
+	if err := codec.Encode(BuildHelloMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := Message{}
+	if err := codec.Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if contents := hello.Contents.(HelloMessage); contents.Status != SUCCESS {
+		t.Fatalf("Expected the HELLO to be accepted but got %+v", contents)
+	}
+
+	request := BuildMessage(LIST_ROOMS, ListRoomsMessage{})
+	request.RequestId = 3
+	if err := codec.Encode(request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := Message{}
+	if err := codec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Command != LIST_ROOMS || reply.RequestId != 3 {
+		t.Fatalf("Expected the LIST_ROOMS reply but got %+v", reply)
+	}
+
+	// A frame over the limit gets the connection dropped rather than read into memory
+	if err := connection.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", MAX_JSON_LINE+1))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := codec.Decode(&Message{}); err == nil {
+		t.Fatal("Expected the connection to be closed after an oversized frame")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("Timed out waiting for the connection to be closed after an oversized frame")
+	}
+}
+
+func TestWebSocketOriginCheck(t *testing.T) {
+	if buildOriginCheck(nil) != nil {
+		t.Fatal("Expected no allowed origins to leave the upgrader's same-origin check in place")
+	}
+
+	check := buildOriginCheck([]string{"https://chat.example.com"})
+
+	for origin, allowed := range map[string]bool{"https://chat.example.com": true, "https://evil.example.com": false, "": false} {
+		request, _ := http.NewRequest("GET", "/chat", nil)
+		request.Header.Set("Origin", origin)
+
+		if check(request) != allowed {
+			t.Fatalf("Expected the origin '%s' to be allowed: %v", origin, allowed)
+		}
+	}
+}